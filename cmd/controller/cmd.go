@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sapcc/go-bits/httpext"
+	"github.com/sapcc/go-bits/must"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/sapcc/netappsd/cmd/master"
+)
+
+var Cmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Run a master for every NetAppExporterPool",
+	Long: `
+Run the master as a controller: a master is started for every
+NetAppExporterPool with the netbox filter, worker deployment and scaling policy
+of the pool, and the discovered filers, assignments and conditions are written
+into the status of the pool. The endpoints of a pool's master are served under
+/pools/<namespace>/<name>/, which is the master url of the pool's workers.`,
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		master.BindNetboxFlags(cmd.Flags())
+		viper.BindPFlag("admin_token", cmd.Flags().Lookup("admin-token"))
+		viper.BindPFlag("discovery_debounce", cmd.Flags().Lookup("discovery-debounce"))
+		viper.BindPFlag("inventory_dir", cmd.Flags().Lookup("inventory-dir"))
+		viper.BindPFlag("listen_addr", cmd.Flags().Lookup("listen-addr"))
+		viper.BindPFlag("reconcile_interval", cmd.Flags().Lookup("reconcile-interval"))
+		viper.BindPFlag("watch_namespace", cmd.Flags().Lookup("watch-namespace"))
+		viper.BindPFlag("webhook_secret", cmd.Flags().Lookup("webhook-secret"))
+	},
+	Run: func(cmd *cobra.Command, _ []string) {
+		ctx := httpext.ContextWithSIGINT(context.Background(), 0)
+
+		c := &Controller{
+			Namespace:         viper.GetString("watch_namespace"),
+			Interval:          viper.GetDuration("reconcile_interval"),
+			NetboxHost:        viper.GetString("netbox_host"),
+			NetboxToken:       viper.GetString("netbox_token"),
+			NetboxOptions:     master.NetboxClientOptions(),
+			NetAppUsername:    viper.GetString("netapp_username"),
+			NetAppPassword:    viper.GetString("netapp_password"),
+			WebhookSecret:     viper.GetString("webhook_secret"),
+			AdminToken:        viper.GetString("admin_token"),
+			InventoryDir:      viper.GetString("inventory_dir"),
+			DiscoveryDebounce: viper.GetDuration("discovery_debounce"),
+		}
+
+		slog.Info("starting netappsd controller", "namespace", c.Namespace)
+		if err := c.Run(ctx); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/pools/", c)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		mux.Handle("/metrics", promhttp.Handler())
+		must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("listen_addr"), mux))
+	},
+}
+
+func init() {
+	Cmd.Flags().StringP("admin-token", "", "", "The bearer token required to pin, exclude and drain; the override endpoints are disabled if empty")
+	Cmd.Flags().DurationP("discovery-debounce", "", 10*time.Second, "The time to wait for further netbox changes before a triggered discovery")
+	Cmd.Flags().StringP("inventory-dir", "", "", "The directory to persist the last known netbox inventory of the pools")
+	Cmd.Flags().StringP("listen-addr", "l", ":8080", "The address to listen on")
+	master.AddNetboxFlags(Cmd.Flags())
+	// the pools have their own netbox filter
+	Cmd.Flags().MarkHidden("region")
+	Cmd.Flags().MarkHidden("tag")
+	Cmd.Flags().DurationP("reconcile-interval", "", 30*time.Second, "The interval to reconcile the pools and update their status")
+	Cmd.Flags().StringP("watch-namespace", "", "", "The namespace of the pools; all namespaces if empty")
+	Cmd.Flags().StringP("webhook-secret", "", "", "The secret to verify netbox webhooks; the webhook endpoint is disabled if empty")
+}
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/sapcc/netappsd/cmd/master"
+	"github.com/sapcc/netappsd/internal/netappsd"
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+	"github.com/sapcc/netappsd/internal/pkg/pool"
+	"github.com/sapcc/netappsd/internal/pkg/utils"
+)
+
+// Controller runs a master for every NetAppExporterPool and writes the state
+// of the masters into the status of the pools.
+type Controller struct {
+	// Namespace is the namespace of the pools; all namespaces if empty.
+	Namespace string
+	// Interval is the interval to reconcile the pools.
+	Interval time.Duration
+
+	NetboxHost        string
+	NetboxToken       string
+	NetboxOptions     *netbox.ClientOptions
+	NetAppUsername    string
+	NetAppPassword    string
+	WebhookSecret     string
+	AdminToken        string
+	InventoryDir      string
+	DiscoveryDebounce time.Duration
+
+	dynamicClient dynamic.Interface
+	kubeClientset kubernetes.Interface
+	pools         map[string]*poolMaster
+	mu            sync.RWMutex
+}
+
+// poolMaster is the master of a pool, started with the generation of the
+// pool's spec.
+type poolMaster struct {
+	*master.NetappsdMaster
+	generation int64
+	handler    http.Handler
+	cancel     context.CancelFunc
+	startErr   error
+}
+
+// Run starts reconciling the pools every interval.
+func (c *Controller) Run(ctx context.Context) error {
+	var err error
+	if c.dynamicClient, err = utils.NewDynamicClient(); err != nil {
+		return err
+	}
+	if c.kubeClientset, err = utils.NewKubeClient(); err != nil {
+		return err
+	}
+	c.pools = make(map[string]*poolMaster)
+
+	go func() {
+		tick := new(utils.TickTick)
+		for {
+			select {
+			case <-tick.Every(c.Interval):
+			case <-ctx.Done():
+				return
+			}
+			if err := c.reconcile(ctx); err != nil {
+				slog.Error("reconcile pools failed", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reconcile starts masters for new pools, restarts the masters of changed
+// pools, stops the masters of deleted pools and updates the status of the
+// pools.
+func (c *Controller) reconcile(ctx context.Context) error {
+	list, err := c.dynamicClient.Resource(pool.Resource).Namespace(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(list.Items))
+	for i := range list.Items {
+		p, err := pool.FromUnstructured(&list.Items[i])
+		if err != nil {
+			slog.Warn("skip pool", "error", err)
+			continue
+		}
+		key := p.Namespace + "/" + p.Name
+		seen[key] = struct{}{}
+
+		pm := c.pools[key]
+		if pm == nil || pm.generation != p.Generation {
+			if pm != nil {
+				slog.Info("restart master of changed pool", "pool", key, "generation", p.Generation)
+				pm.cancel()
+				pm.Wait()
+			} else {
+				slog.Info("start master of pool", "pool", key)
+			}
+			pm = c.startPool(ctx, p)
+			c.mu.Lock()
+			c.pools[key] = pm
+			c.mu.Unlock()
+		}
+		if err := c.updateStatus(ctx, p, pm); err != nil {
+			slog.Warn("failed to update pool status", "pool", key, "error", err)
+		}
+	}
+
+	for key, pm := range c.pools {
+		if _, found := seen[key]; !found {
+			slog.Info("stop master of deleted pool", "pool", key)
+			pm.cancel()
+			pm.Wait()
+			c.mu.Lock()
+			delete(c.pools, key)
+			c.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// startPool starts a master with the spec of the pool. If the master fails to
+// start, it is started again in the next reconcile.
+func (c *Controller) startPool(ctx context.Context, p *pool.NetAppExporterPool) *poolMaster {
+	workerLabel := p.Spec.Worker.Label
+	if workerLabel == "" {
+		workerLabel = "name=" + p.Spec.Worker.Deployment
+	}
+	workerPort := p.Spec.Worker.Port
+	if workerPort == 0 {
+		workerPort = 8082
+	}
+	inventoryFile := ""
+	if c.InventoryDir != "" {
+		inventoryFile = filepath.Join(c.InventoryDir, p.Namespace+"_"+p.Name+".json")
+	}
+
+	m := &master.NetappsdMaster{
+		WebhookSecret: c.WebhookSecret,
+		AdminToken:    c.AdminToken,
+		NetAppSD: &netappsd.NetAppSD{
+			Pool:           p.Namespace + "/" + p.Name,
+			NetboxHost:     c.NetboxHost,
+			NetboxToken:    c.NetboxToken,
+			NetboxOptions:  c.NetboxOptions,
+			Namespace:      p.Namespace,
+			Region:         p.Spec.Netbox.Region,
+			FilerTag:       p.Spec.Netbox.Tag,
+			WorkerName:     p.Spec.Worker.Deployment,
+			WorkerLabel:    workerLabel,
+			WorkerPort:     workerPort,
+			NetAppUsername: c.NetAppUsername,
+			NetAppPassword: c.NetAppPassword,
+			InventoryFile:  inventoryFile,
+
+			OverridesConfigMap: p.Name + "-overrides",
+
+			DiscoveryDebounce: c.DiscoveryDebounce,
+			MinReplicas:       p.Spec.Scaling.MinReplicas,
+			MaxReplicas:       p.Spec.Scaling.MaxReplicas,
+			MaxScaleUp:        p.Spec.Scaling.MaxScaleUp,
+			MaxScaleDown:      p.Spec.Scaling.MaxScaleDown,
+			ScaleUpCooldown:   p.Spec.Scaling.ScaleUpCooldown.Duration,
+			ScaleDownCooldown: p.Spec.Scaling.ScaleDownCooldown.Duration,
+			QueuePolicy:       netappsd.QueuePolicy(p.Spec.Queue),
+			Rebalance:         p.Spec.Rebalance.Enabled,
+			RebalanceInterval: p.Spec.Rebalance.Interval.Duration,
+			Retire:            p.Spec.Scaling.Retire,
+			WorkerMode:        p.Spec.Worker.Mode,
+		},
+	}
+
+	if t := p.Spec.Template; t != nil && t.Render {
+		m.ConfigLabels = t.Labels
+		m.ConfigVolume = t.Volume
+		m.ConfigTemplate = func(ctx context.Context) (*harvest.Template, error) {
+			return c.loadTemplate(ctx, p)
+		}
+	}
+
+	masterCtx, cancel := context.WithCancel(ctx)
+	pm := &poolMaster{
+		NetappsdMaster: m,
+		generation:     p.Generation,
+		cancel:         cancel,
+	}
+	if err := m.Run(masterCtx, netappsd.WithKubeClient(c.kubeClientset)); err != nil {
+		slog.Error("failed to start master of pool", "pool", p.Namespace+"/"+p.Name, "error", err)
+		cancel()
+		pm.startErr = err
+		// start again in the next reconcile
+		pm.generation = 0
+		return pm
+	}
+	pm.handler = http.StripPrefix(poolPath(p.Namespace, p.Name), httpapi.Compose(m))
+	return pm
+}
+
+// updateStatus writes the state of the pool's master into the pool status,
+// if it changed.
+func (c *Controller) updateStatus(ctx context.Context, p *pool.NetAppExporterPool, pm *poolMaster) error {
+	status := p.Status
+	status.Conditions = append([]metav1.Condition(nil), p.Status.Conditions...)
+	status.ObservedGeneration = p.Generation
+
+	if pm.startErr != nil {
+		setCondition(&status, pool.ConditionReady, false, "StartFailed", pm.startErr.Error())
+	} else if s, err := pm.Status(ctx); err != nil {
+		setCondition(&status, pool.ConditionReady, false, "StatusFailed", err.Error())
+	} else {
+		status.Filers = make([]pool.FilerStatus, 0, len(s.Filers))
+		for _, f := range s.Filers {
+			status.Filers = append(status.Filers, pool.FilerStatus{
+				Name:             f.Name,
+				Host:             f.Host,
+				AvailabilityZone: f.AvailabilityZone,
+				Worker:           f.Worker,
+			})
+		}
+		status.Queue = s.Queue
+		status.Unassigned = s.Unassigned
+		if pm.IsReady() {
+			setCondition(&status, pool.ConditionReady, true, "Discovered", fmt.Sprintf("%d filers discovered", len(s.Filers)))
+		} else {
+			setCondition(&status, pool.ConditionReady, false, "Discovering", "waiting for the first filer discovery")
+		}
+		if s.NetboxError != "" {
+			setCondition(&status, pool.ConditionNetboxReachable, false, "NetboxUnreachable", s.NetboxError)
+		} else {
+			setCondition(&status, pool.ConditionNetboxReachable, true, "NetboxReachable", "")
+		}
+	}
+
+	if p.Spec.Template != nil {
+		if err := c.validateTemplate(ctx, p); err != nil {
+			setCondition(&status, pool.ConditionTemplateValid, false, "InvalidTemplate", err.Error())
+		} else {
+			setCondition(&status, pool.ConditionTemplateValid, true, "TemplateRendered", "")
+		}
+	} else {
+		meta.RemoveStatusCondition(&status.Conditions, pool.ConditionTemplateValid)
+	}
+
+	if equality.Semantic.DeepEqual(p.Status, status) {
+		return nil
+	}
+	p.Status = status
+	u, err := p.ToUnstructured()
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamicClient.Resource(pool.Resource).Namespace(p.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// loadTemplate parses the pool's template from its ConfigMap.
+func (c *Controller) loadTemplate(ctx context.Context, p *pool.NetAppExporterPool) (*harvest.Template, error) {
+	t := p.Spec.Template
+	cm, err := c.kubeClientset.CoreV1().ConfigMaps(p.Namespace).Get(ctx, t.ConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	text, found := cm.Data[t.Key]
+	if !found {
+		return nil, fmt.Errorf("key %s not found in configmap %s", t.Key, t.ConfigMap)
+	}
+	return harvest.ParseTemplateText(t.Key, text)
+}
+
+// validateTemplate renders the pool's template from its ConfigMap.
+func (c *Controller) validateTemplate(ctx context.Context, p *pool.NetAppExporterPool) error {
+	tpl, err := c.loadTemplate(ctx, p)
+	if err != nil {
+		return err
+	}
+	return tpl.Validate(harvest.TemplateData{
+		Region: p.Spec.Netbox.Region,
+		Labels: p.Spec.Template.Labels,
+	})
+}
+
+func setCondition(status *pool.Status, conditionType string, ok bool, reason, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if ok {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: status.ObservedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// ServeHTTP serves the endpoints of the pools' masters under
+// /pools/<namespace>/<name>/, e.g. /pools/netapp-exporters/cinder/next/filer.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/pools/"), "/", 3)
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.RLock()
+	pm := c.pools[parts[0]+"/"+parts[1]]
+	c.mu.RUnlock()
+	if pm == nil {
+		http.Error(w, "pool not found", http.StatusNotFound)
+		return
+	}
+	if pm.handler == nil {
+		http.Error(w, "master of pool failed to start: "+pm.startErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	pm.handler.ServeHTTP(w, r)
+}
+
+func poolPath(namespace, name string) string {
+	return "/pools/" + namespace + "/" + name
+}
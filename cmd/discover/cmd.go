@@ -0,0 +1,165 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"sigs.k8s.io/yaml"
+
+	"github.com/sapcc/netappsd/cmd/master"
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+var (
+	outputFormat string
+	probe        bool
+)
+
+var Cmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Discover filers from netbox and print them",
+	Long: `
+Discover filers from netbox with the same flags as the master and print them.
+With --probe, every discovered filer is probed like the master does. The
+command exits with a non-zero code if netbox can not be queried or a probe
+fails. Environment variables are also read from a .env file.`,
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		master.BindNetboxFlags(cmd.Flags())
+	},
+	RunE:          run,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	master.AddNetboxFlags(Cmd.Flags())
+	Cmd.Flags().StringVarP(&outputFormat, "output", "o", "table", "The output format: table, json or yaml")
+	Cmd.Flags().BoolVarP(&probe, "probe", "p", false, "Probe the discovered filers")
+}
+
+// discoveredFiler is a filer with the result of its probe.
+type discoveredFiler struct {
+	netbox.Filer
+	Probe string `json:"probe,omitempty" yaml:"probe,omitempty"`
+}
+
+func run(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// the .env file is optional, e.g. for running on a laptop
+	_ = godotenv.Load()
+
+	switch outputFormat {
+	case "table", "json", "yaml":
+	default:
+		return fmt.Errorf("unknown output format %s", outputFormat)
+	}
+
+	client, err := netbox.NewClient(viper.GetString("netbox_host"), viper.GetString("netbox_token"), master.NetboxClientOptions())
+	if err != nil {
+		return err
+	}
+	filers, err := client.GetFilers(ctx, viper.GetString("region"), viper.GetString("tag"))
+	if err != nil {
+		return fmt.Errorf("failed to get filers from netbox: %w", err)
+	}
+
+	result := make([]discoveredFiler, len(filers))
+	for i, f := range filers {
+		result[i].Filer = f
+	}
+	failed := 0
+	if probe {
+		failed = probeFilers(ctx, result)
+	}
+
+	if err := printFilers(os.Stdout, result); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d filers failed probing", failed, len(result))
+	}
+	return nil
+}
+
+// probeFilers probes the filers in parallel and returns the number of failed
+// probes. Filers that are not active in netbox are not probed.
+func probeFilers(ctx context.Context, filers []discoveredFiler) int {
+	username := viper.GetString("netapp_username")
+	password := viper.GetString("netapp_password")
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	failed := 0
+
+	for i := range filers {
+		f := &filers[i]
+		if f.Status != "active" {
+			f.Probe = "skipped: " + f.Status
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+			defer cancel()
+			addr := f.Ip
+			if addr == "" {
+				addr = f.Host
+			}
+			if err := netapp.NewFilerClient(addr, username, password).Probe(ctx); err != nil {
+				f.Probe = err.Error()
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			f.Probe = "ok"
+		}()
+	}
+
+	wg.Wait()
+	return failed
+}
+
+func printFilers(w io.Writer, filers []discoveredFiler) error {
+	switch outputFormat {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(filers)
+	case "yaml":
+		b, err := yaml.Marshal(filers)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if probe {
+		fmt.Fprintln(tw, "NAME\tHOST\tIP\tSTATUS\tAZ\tPROBE")
+	} else {
+		fmt.Fprintln(tw, "NAME\tHOST\tIP\tSTATUS\tAZ")
+	}
+	for _, f := range filers {
+		if probe {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Name, f.Host, f.Ip, f.Status, f.AvailabilityZone, f.Probe)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Name, f.Host, f.Ip, f.Status, f.AvailabilityZone)
+		}
+	}
+	return tw.Flush()
+}
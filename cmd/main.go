@@ -8,7 +8,13 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/sapcc/netappsd/cmd/controller"
+	"github.com/sapcc/netappsd/cmd/discover"
 	"github.com/sapcc/netappsd/cmd/master"
+	"github.com/sapcc/netappsd/cmd/override"
+	"github.com/sapcc/netappsd/cmd/render"
+	"github.com/sapcc/netappsd/cmd/simulate"
+	"github.com/sapcc/netappsd/cmd/status"
 	"github.com/sapcc/netappsd/cmd/worker"
 	"github.com/sapcc/netappsd/internal/pkg/utils"
 )
@@ -34,9 +40,20 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Enable debug logging")
 	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
+	rootCmd.PersistentFlags().StringP("context", "", "", "The kubeconfig context to use outside of a cluster")
+	rootCmd.PersistentFlags().StringP("kubeconfig", "", "", "The kubeconfig file to use outside of a cluster (env KUBECONFIG, default ~/.kube/config)")
+	rootCmd.PersistentFlags().StringP("namespace", "", "", "The namespace of the workers (env POD_NAMESPACE)")
+	viper.BindPFlag("context", rootCmd.PersistentFlags().Lookup("context"))
+	viper.BindPFlag("pod_namespace", rootCmd.PersistentFlags().Lookup("namespace"))
 
 	rootCmd.AddCommand(master.Cmd)
+	rootCmd.AddCommand(controller.Cmd)
 	rootCmd.AddCommand(worker.Cmd)
+	rootCmd.AddCommand(render.Cmd)
+	rootCmd.AddCommand(discover.Cmd)
+	rootCmd.AddCommand(status.Cmd)
+	rootCmd.AddCommand(simulate.Cmd)
+	rootCmd.AddCommand(override.Cmd)
 
 	logLvl := new(slog.LevelVar)
 	addSource := false
@@ -52,4 +69,8 @@ func init() {
 
 func initConfig() {
 	viper.AutomaticEnv()
+	// KUBECONFIG is read by the kubeconfig loading rules, the flag is an
+	// explicit path
+	kubeconfig, _ := rootCmd.PersistentFlags().GetString("kubeconfig")
+	utils.SetKubeConfig(kubeconfig, viper.GetString("context"))
 }
@@ -6,19 +6,27 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/netappsd/internal/netappsd"
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+	"github.com/sapcc/netappsd/internal/pkg/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var Cmd = &cobra.Command{
 	Use:   "master",
 	Short: "Netappsd master: discover filers from netbox",
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		BindNetboxFlags(cmd.Flags())
+	},
 	Run: func(cmd *cobra.Command, _ []string) {
 		ctx := httpext.ContextWithSIGINT(context.Background(), 0)
 
@@ -28,6 +36,10 @@ var Cmd = &cobra.Command{
 		}))
 		slog.SetDefault(l)
 
+		if viper.GetString("pod_namespace") == "" {
+			slog.Error("the namespace of the workers is not set, use --namespace or POD_NAMESPACE")
+			os.Exit(1)
+		}
 		workerName := viper.GetString("worker")
 		workerLabel := viper.GetString("worker_label")
 		if workerLabel == "" {
@@ -35,16 +47,52 @@ var Cmd = &cobra.Command{
 		}
 
 		netappsdMaster := new(NetappsdMaster)
+		netappsdMaster.WebhookSecret = viper.GetString("webhook_secret")
+		netappsdMaster.AdminToken = viper.GetString("admin_token")
 		netappsdMaster.NetAppSD = &netappsd.NetAppSD{
 			NetboxHost:     viper.GetString("netbox_host"),
 			NetboxToken:    viper.GetString("netbox_token"),
+			NetboxOptions:  NetboxClientOptions(),
 			Namespace:      viper.GetString("pod_namespace"),
 			Region:         viper.GetString("region"),
 			FilerTag:       viper.GetString("tag"),
 			WorkerName:     workerName,
 			WorkerLabel:    workerLabel,
+			WorkerPort:     viper.GetInt("worker_port"),
 			NetAppUsername: viper.GetString("netapp_username"),
 			NetAppPassword: viper.GetString("netapp_password"),
+			InventoryFile:  viper.GetString("inventory_file"),
+
+			OverridesConfigMap: viper.GetString("overrides_configmap"),
+
+			DiscoveryDebounce: viper.GetDuration("discovery_debounce"),
+			WorkerMode:        viper.GetString("worker_mode"),
+			Replicas:          viper.GetString("replicas"),
+			Retire:            viper.GetString("retire"),
+			MinReplicas:       viper.GetInt32("min_replicas"),
+			MaxReplicas:       viper.GetInt32("max_replicas"),
+			MaxScaleUp:        viper.GetInt32("max_scale_up"),
+			MaxScaleDown:      viper.GetInt32("max_scale_down"),
+			ScaleUpCooldown:   viper.GetDuration("scale_up_cooldown"),
+			ScaleDownCooldown: viper.GetDuration("scale_down_cooldown"),
+			DryRun:            viper.GetBool("dry_run"),
+			QueuePolicy: netappsd.QueuePolicy{
+				PriorityTags:  viper.GetStringSlice("queue_priority_tag"),
+				PriorityField: viper.GetString("queue_priority_field"),
+				LabTag:        viper.GetString("queue_lab_tag"),
+				AZFairness:    viper.GetBool("queue_az_fairness"),
+			},
+			Rebalance:         viper.GetBool("rebalance"),
+			RebalanceInterval: viper.GetDuration("rebalance_interval"),
+			ConfigLabels:      viper.GetStringMapString("config_label"),
+			ConfigVolume:      viper.GetString("config_volume"),
+		}
+		if templateFile := viper.GetString("config_template"); templateFile != "" {
+			// parse the template on every update, so that changes of the
+			// mounted template are rolled out
+			netappsdMaster.ConfigTemplate = func(context.Context) (*harvest.Template, error) {
+				return harvest.ParseTemplate(templateFile)
+			}
 		}
 
 		slog.Info("starting netappsd master")
@@ -55,27 +103,127 @@ var Cmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if addr := viper.GetString("external_metrics_addr"); addr != "" {
+			cert, err := externalMetricsCertificate()
+			if err != nil {
+				slog.Error("failed to load external metrics certificate", "error", err)
+				os.Exit(1)
+			}
+			auth, err := newDelegatedAuth(ctx)
+			if err != nil {
+				slog.Error("failed to load the authentication of aggregated apis", "error", err)
+				os.Exit(1)
+			}
+			go func() {
+				must.Succeed(utils.ListenAndServeTLSContext(ctx, addr, auth.tlsConfig(cert), auth.wrap(netappsdMaster.ExternalMetricsHandler())))
+			}()
+		}
+
 		mux := http.NewServeMux()
 		mux.Handle("/", httpapi.Compose(netappsdMaster))
 		mux.Handle("/metrics", promhttp.Handler())
 		must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("listen_addr"), mux))
+		netappsdMaster.Wait()
 	},
 }
 
 func init() {
+	Cmd.Flags().StringP("admin-token", "", "", "The bearer token required to pin, exclude and drain; the override endpoints are disabled if empty")
+	Cmd.Flags().StringToStringP("config-label", "", nil, "Custom labels passed to --config-template, e.g. --config-label env=prod")
+	Cmd.Flags().StringP("config-template", "", "", "Render the harvest config with this template into a secret per filer; requires --worker-mode per-filer")
+	Cmd.Flags().StringP("config-volume", "", "shared", "The volume of the worker deployment that is replaced by the secret of the rendered config")
+	Cmd.Flags().BoolP("dry-run", "", false, "Only log and report the planned changes of pods, deployments and secrets at /plan")
+	Cmd.Flags().DurationP("discovery-debounce", "", 10*time.Second, "The time to wait for further netbox changes before a triggered discovery")
+	Cmd.Flags().StringP("external-metrics-addr", "", "", "The address to serve the external metrics API with TLS on, e.g. :8443; disabled if empty")
+	Cmd.Flags().StringP("inventory-file", "", "", "The file to persist the last known netbox inventory")
 	Cmd.Flags().StringP("listen-addr", "l", ":8080", "The address to listen on")
-	Cmd.Flags().StringP("netbox-host", "", "netbox.staging.cloud.sap", "The netbox host to query")
-	Cmd.Flags().StringP("netbox-token", "", "", "The token to authenticate against netbox")
-	Cmd.Flags().StringP("region", "r", "", "The region to filter netbox devices")
-	Cmd.Flags().StringP("tag", "t", "", "The tag to filter netbox devices")
+	Cmd.Flags().Int32P("max-replicas", "", 0, "The maximum replicas of the worker deployment; no limit if 0")
+	Cmd.Flags().Int32P("max-scale-down", "", 0, "The maximum replicas removed from the worker deployment in one update; no limit if 0")
+	Cmd.Flags().Int32P("max-scale-up", "", 0, "The maximum replicas added to the worker deployment in one update; no limit if 0")
+	Cmd.Flags().Int32P("min-replicas", "", 0, "The minimum replicas of the worker deployment, which is scaled up to it")
+	Cmd.Flags().BoolP("queue-az-fairness", "", true, "Let the availability zones take turns among queued filers of the same priority")
+	Cmd.Flags().StringP("queue-lab-tag", "", "lab", "The netbox tag of lab filers, which are queued after production filers")
+	Cmd.Flags().StringP("queue-priority-field", "", "", "The netbox custom field with a numeric priority of the filer; higher priorities are queued first")
+	Cmd.Flags().StringSliceP("queue-priority-tag", "", nil, "The netbox tags in order of priority; filers with the first tag are queued first")
+	Cmd.Flags().BoolP("rebalance", "", false, "Move filers to free workers in the availability zone of the filer")
+	Cmd.Flags().DurationP("rebalance-interval", "", 10*time.Minute, "The minimum time between two filer moves of the rebalancer")
+	Cmd.Flags().StringP("replicas", "", netappsd.ReplicasMaster, "master: set the replicas of the worker deployment; external: leave them to an autoscaler")
+	Cmd.Flags().StringP("retire", "", netappsd.RetireDeletionCost, "deletion-cost: mark retired workers and scale down once no filer is queued; evict: evict retired workers, honouring PodDisruptionBudgets, and scale down")
+	Cmd.Flags().DurationP("scale-down-cooldown", "", 0, "The time after any scaling of the worker deployment before a scale down")
+	Cmd.Flags().DurationP("scale-up-cooldown", "", 0, "The time after a scale up of the worker deployment before the next scale up")
+	Cmd.Flags().StringP("tls-cert-file", "", "", "The certificate of the external metrics API; self-signed if empty")
+	Cmd.Flags().StringP("tls-key-file", "", "", "The key of --tls-cert-file")
+	Cmd.Flags().StringP("overrides-configmap", "", "netappsd-overrides", "The configmap to persist pins, exclusions and drains in")
+	AddNetboxFlags(Cmd.Flags())
 	Cmd.Flags().StringP("worker", "w", "", "The deployment name of workers")
+	Cmd.Flags().StringP("webhook-secret", "", "", "The secret to verify netbox webhooks; the webhook endpoint is disabled if empty")
 	Cmd.Flags().StringP("worker-label", "", "", "The label of worker pods")
+	Cmd.Flags().StringP("worker-mode", "", netappsd.WorkerModeShared, "shared: scale the worker deployment and assign filers to its pods; per-filer: create a deployment per filer from the worker deployment")
+	Cmd.Flags().IntP("worker-port", "", 8082, "The port workers listen on")
 
+	viper.BindPFlag("admin_token", Cmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("config_label", Cmd.Flags().Lookup("config-label"))
+	viper.BindPFlag("config_template", Cmd.Flags().Lookup("config-template"))
+	viper.BindPFlag("config_volume", Cmd.Flags().Lookup("config-volume"))
+	viper.BindPFlag("dry_run", Cmd.Flags().Lookup("dry-run"))
+	viper.BindPFlag("discovery_debounce", Cmd.Flags().Lookup("discovery-debounce"))
+	viper.BindPFlag("external_metrics_addr", Cmd.Flags().Lookup("external-metrics-addr"))
+	viper.BindPFlag("inventory_file", Cmd.Flags().Lookup("inventory-file"))
 	viper.BindPFlag("listen_addr", Cmd.Flags().Lookup("listen-addr"))
-	viper.BindPFlag("netbox_host", Cmd.Flags().Lookup("netbox-host"))
-	viper.BindPFlag("netbox_token", Cmd.Flags().Lookup("netbox-token"))
-	viper.BindPFlag("tag", Cmd.Flags().Lookup("tag"))
-	viper.BindPFlag("region", Cmd.Flags().Lookup("region"))
+	viper.BindPFlag("max_replicas", Cmd.Flags().Lookup("max-replicas"))
+	viper.BindPFlag("max_scale_down", Cmd.Flags().Lookup("max-scale-down"))
+	viper.BindPFlag("max_scale_up", Cmd.Flags().Lookup("max-scale-up"))
+	viper.BindPFlag("min_replicas", Cmd.Flags().Lookup("min-replicas"))
+	viper.BindPFlag("queue_az_fairness", Cmd.Flags().Lookup("queue-az-fairness"))
+	viper.BindPFlag("queue_lab_tag", Cmd.Flags().Lookup("queue-lab-tag"))
+	viper.BindPFlag("queue_priority_field", Cmd.Flags().Lookup("queue-priority-field"))
+	viper.BindPFlag("queue_priority_tag", Cmd.Flags().Lookup("queue-priority-tag"))
+	viper.BindPFlag("rebalance", Cmd.Flags().Lookup("rebalance"))
+	viper.BindPFlag("rebalance_interval", Cmd.Flags().Lookup("rebalance-interval"))
+	viper.BindPFlag("replicas", Cmd.Flags().Lookup("replicas"))
+	viper.BindPFlag("retire", Cmd.Flags().Lookup("retire"))
+	viper.BindPFlag("scale_down_cooldown", Cmd.Flags().Lookup("scale-down-cooldown"))
+	viper.BindPFlag("scale_up_cooldown", Cmd.Flags().Lookup("scale-up-cooldown"))
+	viper.BindPFlag("tls_cert_file", Cmd.Flags().Lookup("tls-cert-file"))
+	viper.BindPFlag("tls_key_file", Cmd.Flags().Lookup("tls-key-file"))
+	viper.BindPFlag("overrides_configmap", Cmd.Flags().Lookup("overrides-configmap"))
 	viper.BindPFlag("worker", Cmd.Flags().Lookup("worker"))
+	viper.BindPFlag("webhook_secret", Cmd.Flags().Lookup("webhook-secret"))
 	viper.BindPFlag("worker_label", Cmd.Flags().Lookup("worker-label"))
+	viper.BindPFlag("worker_mode", Cmd.Flags().Lookup("worker-mode"))
+	viper.BindPFlag("worker_port", Cmd.Flags().Lookup("worker-port"))
+}
+
+// AddNetboxFlags adds the flags to query netbox for filers. They are shared by
+// the master and the discover command.
+func AddNetboxFlags(flags *pflag.FlagSet) {
+	flags.StringP("netbox-host", "", "netbox.staging.cloud.sap", "The netbox host to query")
+	flags.StringP("netbox-token", "", "", "The token to authenticate against netbox")
+	flags.IntP("netbox-max-retries", "", 5, "The number of retries of failed netbox requests, 0 disables retries")
+	flags.Float64P("netbox-rate-limit", "", 10, "The maximum number of netbox requests per second")
+	flags.StringP("region", "r", "", "The region to filter netbox devices")
+	flags.StringP("tag", "t", "", "The tag to filter netbox devices")
+}
+
+// BindNetboxFlags binds the netbox flags to viper. Viper keys are global, so
+// commands sharing the flags bind them right before they run.
+func BindNetboxFlags(flags *pflag.FlagSet) {
+	viper.BindPFlag("netbox_host", flags.Lookup("netbox-host"))
+	viper.BindPFlag("netbox_token", flags.Lookup("netbox-token"))
+	viper.BindPFlag("netbox_max_retries", flags.Lookup("netbox-max-retries"))
+	viper.BindPFlag("netbox_rate_limit", flags.Lookup("netbox-rate-limit"))
+	viper.BindPFlag("region", flags.Lookup("region"))
+	viper.BindPFlag("tag", flags.Lookup("tag"))
+}
+
+// NetboxClientOptions returns the netbox client options set by the flags.
+func NetboxClientOptions() *netbox.ClientOptions {
+	maxRetries := viper.GetInt("netbox_max_retries")
+	if maxRetries == 0 {
+		maxRetries = netbox.NoRetries
+	}
+	return &netbox.ClientOptions{
+		MaxRetries: maxRetries,
+		RateLimit:  viper.GetFloat64("netbox_rate_limit"),
+	}
 }
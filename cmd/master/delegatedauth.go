@@ -0,0 +1,155 @@
+package master
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sapcc/go-bits/respondwith"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/sapcc/netappsd/internal/pkg/utils"
+)
+
+// delegatedAuth authenticates and authorizes the requests of the external
+// metrics API like an aggregated API server. The kube-apiserver proxies them
+// with the client certificate of its front proxy, which is signed by the
+// requestheader client CA of the ConfigMap
+// kube-system/extension-apiserver-authentication, and passes the user in the
+// request headers. The user is authorized with a SubjectAccessReview.
+type delegatedAuth struct {
+	clientset       kubernetes.Interface
+	clientCAs       *x509.CertPool
+	allowedNames    []string
+	usernameHeaders []string
+	groupHeaders    []string
+}
+
+// newDelegatedAuth loads the requestheader configuration of the
+// kube-apiserver. It requires the role extension-apiserver-authentication-reader
+// in kube-system and the cluster role system:auth-delegator.
+func newDelegatedAuth(ctx context.Context) (*delegatedAuth, error) {
+	clientset, err := utils.NewKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := clientset.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(ctx, "extension-apiserver-authentication", metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	a := &delegatedAuth{clientset: clientset, clientCAs: x509.NewCertPool()}
+	if !a.clientCAs.AppendCertsFromPEM([]byte(cm.Data["requestheader-client-ca-file"])) {
+		return nil, errors.New("no requestheader client CA in extension-apiserver-authentication")
+	}
+	for key, value := range map[string]*[]string{
+		"requestheader-allowed-names":    &a.allowedNames,
+		"requestheader-username-headers": &a.usernameHeaders,
+		"requestheader-group-headers":    &a.groupHeaders,
+	} {
+		if data := cm.Data[key]; data != "" {
+			if err := json.Unmarshal([]byte(data), value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", key, err)
+			}
+		}
+	}
+	if len(a.usernameHeaders) == 0 {
+		return nil, errors.New("no requestheader username headers in extension-apiserver-authentication")
+	}
+	return a, nil
+}
+
+// tlsConfig returns the TLS config with the serving certificate, which
+// verifies the client certificates of the front proxy. Requests without
+// client certificate are rejected by wrap, except for the health check.
+func (a *delegatedAuth) tlsConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    a.clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// wrap authenticates and authorizes the requests to the handler.
+func (a *delegatedAuth) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			respondwith.JSON(w, http.StatusUnauthorized, "missing client certificate")
+			return
+		}
+		proxyName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if len(a.allowedNames) > 0 && !slices.Contains(a.allowedNames, proxyName) {
+			respondwith.JSON(w, http.StatusUnauthorized, "client certificate not allowed")
+			return
+		}
+		user := headerValue(r, a.usernameHeaders)
+		if user == "" {
+			respondwith.JSON(w, http.StatusUnauthorized, "missing user")
+			return
+		}
+		var groups []string
+		for _, h := range a.groupHeaders {
+			groups = append(groups, r.Header.Values(h)...)
+		}
+
+		allowed, err := a.authorize(r, user, groups)
+		if err != nil {
+			slog.Warn("failed to authorize external metrics request", "user", user, "error", err)
+			respondwith.JSON(w, http.StatusInternalServerError, "authorization failed")
+			return
+		}
+		if !allowed {
+			respondwith.JSON(w, http.StatusForbidden, fmt.Sprintf("user %s may not get %s", user, r.URL.Path))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authorize reviews whether the user may get the external metric, or the API
+// resource list of the external metrics API.
+func (a *delegatedAuth) authorize(r *http.Request, user string, groups []string) (bool, error) {
+	spec := authorizationv1.SubjectAccessReviewSpec{User: user, Groups: groups}
+	base := "/apis/" + externalMetricsGroupVersion + "/namespaces/"
+	if rest, found := strings.CutPrefix(r.URL.Path, base); found {
+		namespace, metric, _ := strings.Cut(rest, "/")
+		group, version, _ := strings.Cut(externalMetricsGroupVersion, "/")
+		spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Verb:      "get",
+			Group:     group,
+			Version:   version,
+			Resource:  metric,
+		}
+	} else {
+		spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Path: r.URL.Path, Verb: "get"}
+	}
+	review, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(r.Context(),
+		&authorizationv1.SubjectAccessReview{Spec: spec}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+func headerValue(r *http.Request, headers []string) string {
+	for _, h := range headers {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+	return ""
+}
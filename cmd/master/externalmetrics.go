@@ -0,0 +1,109 @@
+package master
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/sapcc/netappsd/internal/pkg/utils"
+)
+
+const (
+	externalMetricsGroupVersion = "external.metrics.k8s.io/v1beta1"
+	// DesiredWorkersMetric is the external metric with the number of workers
+	// the master wants.
+	DesiredWorkersMetric = "netappsd-desired-workers"
+)
+
+// externalMetricValue is an item of the external metrics API. The types of
+// k8s.io/metrics are not a dependency, so they are declared here.
+type externalMetricValue struct {
+	MetricName   string            `json:"metricName"`
+	MetricLabels map[string]string `json:"metricLabels"`
+	Timestamp    metav1.Time       `json:"timestamp"`
+	Value        resource.Quantity `json:"value"`
+}
+
+type externalMetricValueList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []externalMetricValue `json:"items"`
+}
+
+// ExternalMetricsHandler serves the Kubernetes external metrics API with the
+// desired workers, so that the worker deployment can be scaled by a
+// HorizontalPodAutoscaler. It is registered as APIService, which requires
+// TLS, and is served behind delegatedAuth. The labelSelector of a request is
+// matched against the labels of the metric.
+func (n *NetappsdMaster) ExternalMetricsHandler() http.Handler {
+	r := mux.NewRouter()
+	base := "/apis/" + externalMetricsGroupVersion
+
+	r.Methods("GET").
+		Path(base).
+		HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			respondwith.JSON(w, http.StatusOK, metav1.APIResourceList{
+				TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+				GroupVersion: externalMetricsGroupVersion,
+				APIResources: []metav1.APIResource{{
+					Name:       DesiredWorkersMetric,
+					Namespaced: true,
+					Kind:       "ExternalMetricValueList",
+					Verbs:      []string{"get"},
+				}},
+			})
+		})
+
+	r.Methods("GET").
+		Path(base + "/namespaces/{namespace}/{metric}").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			if vars["metric"] != DesiredWorkersMetric || vars["namespace"] != n.Namespace {
+				respondwith.JSON(w, http.StatusNotFound, "metric not found")
+				return
+			}
+			selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+			if err != nil {
+				respondwith.JSON(w, http.StatusBadRequest, "invalid labelSelector: "+err.Error())
+				return
+			}
+			list := externalMetricValueList{
+				TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: externalMetricsGroupVersion},
+				Items:    []externalMetricValue{},
+			}
+			metricLabels := map[string]string{"worker": n.WorkerName}
+			if selector.Matches(labels.Set(metricLabels)) {
+				list.Items = append(list.Items, externalMetricValue{
+					MetricName:   DesiredWorkersMetric,
+					MetricLabels: metricLabels,
+					Timestamp:    metav1.NewTime(time.Now()),
+					Value:        *resource.NewQuantity(int64(n.Scaling().Desired), resource.DecimalSI),
+				})
+			}
+			respondwith.JSON(w, http.StatusOK, list)
+		})
+
+	r.Methods("GET").
+		Path("/healthz").
+		HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			respondwith.JSON(w, http.StatusOK, "OK")
+		})
+	return r
+}
+
+// externalMetricsCertificate loads the certificate of the external metrics
+// API, or creates a self-signed one.
+func externalMetricsCertificate() (tls.Certificate, error) {
+	certFile := viper.GetString("tls_cert_file")
+	if certFile == "" {
+		return utils.SelfSignedCertificate("netappsd-master")
+	}
+	return tls.LoadX509KeyPair(certFile, viper.GetString("tls_key_file"))
+}
@@ -11,14 +11,20 @@ import (
 
 type NetappsdMaster struct {
 	*netappsd.NetAppSD
+
+	// WebhookSecret is the secret netbox signs webhooks with. The webhook
+	// endpoint is disabled if it is empty.
+	WebhookSecret string
+	// AdminToken is the bearer token required to change overrides. The
+	// endpoints to change overrides are disabled if it is empty.
+	AdminToken string
 }
 
-// AddTo implements the go-bits/httpapi.API interface. It registers the handler
-// for the /next/filer.json endpoint, which returns the next filer to be
-// worked on. It also registers the /healthz endpoint, which is used by the
-// Kubernetes readiness/liveness probe.
+// AddTo implements the go-bits/httpapi.API interface. It registers the
+// endpoints of the workers, the status endpoints, the overrides and the
+// /healthz endpoint, which is used by the Kubernetes readiness/liveness probe.
 func (n *NetappsdMaster) AddTo(r *mux.Router) {
-	// next filer endpoint
+	// next filer endpoint, which returns the next filer to be worked on
 	r.Methods("GET").
 		Path("/next/filer").
 		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -39,12 +45,68 @@ func (n *NetappsdMaster) AddTo(r *mux.Router) {
 			}
 		})
 
-	// health check endpoint
+	// discovered filers endpoint
+	r.Methods("GET").
+		Path("/filers").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondwith.JSON(w, http.StatusOK, n.Filers())
+		})
+
+	// discovered filer endpoint, e.g. for workers to refresh their filer
+	r.Methods("GET").
+		Path("/filers/{name}").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if filer, found := n.Filer(mux.Vars(r)["name"]); found {
+				respondwith.JSON(w, http.StatusOK, filer)
+			} else {
+				respondwith.JSON(w, http.StatusNotFound, "filer not found")
+			}
+		})
+
+	// status endpoint, which returns the queue and worker assignments
+	r.Methods("GET").
+		Path("/status").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status, err := n.Status(r.Context()); err != nil {
+				respondwith.ErrorText(w, err)
+			} else {
+				respondwith.JSON(w, http.StatusOK, status)
+			}
+		})
+
+	// scaling endpoint, which returns the desired workers, e.g. for KEDA
+	r.Methods("GET").
+		Path("/scaling").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondwith.JSON(w, http.StatusOK, n.Scaling())
+		})
+
+	// dry run plan endpoint, which returns the planned actions
+	r.Methods("GET").
+		Path("/plan").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondwith.JSON(w, http.StatusOK, n.Plan())
+		})
+
+	// override endpoints to pin, exclude and drain
+	n.addOverrideRoutes(r)
+
+	// netbox webhook endpoint, which triggers a filer discovery
+	if n.WebhookSecret != "" {
+		r.Methods("POST").
+			Path("/webhook/netbox").
+			HandlerFunc(n.handleNetboxWebhook)
+	}
+
+	// health check endpoint; DEGRADED while the filers are probed from the
+	// last known inventory, since netbox is unreachable
 	r.Methods("GET").
 		Path("/healthz").
 		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !n.IsReady() {
 				respondwith.JSON(w, http.StatusServiceUnavailable, "NOT READY")
+			} else if err := n.NetboxError(); err != nil {
+				respondwith.JSON(w, http.StatusOK, "DEGRADED: "+err.Error())
 			} else {
 				respondwith.JSON(w, http.StatusOK, "OK")
 			}
@@ -0,0 +1,84 @@
+package master
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+// addOverrideRoutes registers the endpoints to pin, exclude and drain. The
+// changing requests must send the admin token as bearer token; they are not
+// registered without an admin token, like the webhook without its secret.
+//
+//	GET    /overrides
+//	PUT    /pin/{filer}?pod=<pod>     DELETE /pin/{filer}
+//	PUT    /exclude/{filer}?reason=   DELETE /exclude/{filer}
+//	PUT    /drain/{pod}?reason=       DELETE /drain/{pod}
+func (n *NetappsdMaster) addOverrideRoutes(r *mux.Router) {
+	r.Methods("GET").
+		Path("/overrides").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondwith.JSON(w, http.StatusOK, n.Overrides())
+		})
+	if n.AdminToken == "" {
+		return
+	}
+
+	r.Methods("PUT").
+		Path("/pin/{filer}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			podname := r.URL.Query().Get("pod")
+			if podname == "" {
+				respondwith.JSON(w, http.StatusBadRequest, "missing pod parameter")
+				return
+			}
+			respondOverride(w, n.PinFiler(r.Context(), mux.Vars(r)["filer"], podname))
+		}))
+	r.Methods("DELETE").
+		Path("/pin/{filer}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			respondOverride(w, n.UnpinFiler(r.Context(), mux.Vars(r)["filer"]))
+		}))
+
+	r.Methods("PUT").
+		Path("/exclude/{filer}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			respondOverride(w, n.ExcludeFiler(r.Context(), mux.Vars(r)["filer"], r.URL.Query().Get("reason")))
+		}))
+	r.Methods("DELETE").
+		Path("/exclude/{filer}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			respondOverride(w, n.IncludeFiler(r.Context(), mux.Vars(r)["filer"]))
+		}))
+
+	r.Methods("PUT").
+		Path("/drain/{pod}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			respondOverride(w, n.DrainWorker(r.Context(), mux.Vars(r)["pod"], r.URL.Query().Get("reason")))
+		}))
+	r.Methods("DELETE").
+		Path("/drain/{pod}").
+		HandlerFunc(n.authorized(func(w http.ResponseWriter, r *http.Request) {
+			respondOverride(w, n.UndrainWorker(r.Context(), mux.Vars(r)["pod"]))
+		}))
+}
+
+func respondOverride(w http.ResponseWriter, err error) {
+	if !respondwith.ErrorText(w, err) {
+		respondwith.JSON(w, http.StatusOK, "OK")
+	}
+}
+
+// authorized checks the admin token.
+func (n *NetappsdMaster) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := "Bearer " + n.AdminToken
+		if n.AdminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			respondwith.JSON(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
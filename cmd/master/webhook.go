@@ -0,0 +1,80 @@
+package master
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+// webhookModels are the netbox models whose changes can affect the filer
+// inventory. Changes to other models are acknowledged and ignored.
+var webhookModels = map[string]struct{}{
+	"device":    {},
+	"devicebay": {},
+	"cluster":   {},
+}
+
+// webhookPayload is the relevant part of the body netbox sends for webhooks.
+//
+// EG https://docs.netbox.dev/en/stable/integrations/webhooks/
+type webhookPayload struct {
+	Event     string `json:"event"`
+	Model     string `json:"model"`
+	RequestID string `json:"request_id"`
+	Data      struct {
+		Name string `json:"name"`
+	} `json:"data"`
+}
+
+// handleNetboxWebhook verifies the signature of a netbox webhook and triggers a
+// discovery of the changed device or cluster, or a full discovery for device
+// bays, which only link the nodes to their filer.
+func (n *NetappsdMaster) handleNetboxWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		respondwith.JSON(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if !verifyWebhookSignature(n.WebhookSecret, body, r.Header.Get("X-Hook-Signature")) {
+		slog.Warn("netbox webhook with invalid signature", "remote", r.RemoteAddr)
+		respondwith.JSON(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		respondwith.JSON(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if _, found := webhookModels[payload.Model]; !found {
+		slog.Debug("ignore netbox webhook", "model", payload.Model, "event", payload.Event)
+		respondwith.JSON(w, http.StatusOK, "ignored")
+		return
+	}
+
+	slog.Info("netbox webhook received", "model", payload.Model, "event", payload.Event, "name", payload.Data.Name, "request", payload.RequestID)
+	if payload.Model == "devicebay" || payload.Data.Name == "" {
+		n.TriggerDiscovery("webhook")
+	} else {
+		n.TriggerFilerDiscovery("webhook", payload.Data.Name)
+	}
+	respondwith.JSON(w, http.StatusAccepted, "discovery triggered")
+}
+
+// verifyWebhookSignature checks the X-Hook-Signature header, which netbox sets
+// to the hex encoded HMAC-SHA512 of the body, keyed with the webhook secret.
+func verifyWebhookSignature(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
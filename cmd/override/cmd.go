@@ -0,0 +1,104 @@
+package override
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Cmd groups the commands to change the overrides of a running master.
+var Cmd = &cobra.Command{
+	Use:   "override",
+	Short: "Change the filer assignment of a running master, e.g. during maintenance",
+}
+
+var cmds = []*cobra.Command{
+	newCmd("pin FILER POD", "Assign a filer only to the given worker pod", 2, http.MethodPut,
+		func(args []string) (string, url.Values) {
+			return "/pin/" + url.PathEscape(args[0]), url.Values{"pod": {args[1]}}
+		}),
+	newCmd("unpin FILER", "Undo pin: assign the filer to any worker", 1, http.MethodDelete,
+		func(args []string) (string, url.Values) {
+			return "/pin/" + url.PathEscape(args[0]), nil
+		}),
+	newCmd("exclude FILER", "Stop scraping a filer, e.g. during maintenance", 1, http.MethodPut,
+		func(args []string) (string, url.Values) {
+			return "/exclude/" + url.PathEscape(args[0]), url.Values{"reason": {reason}}
+		}),
+	newCmd("include FILER", "Undo exclude: scrape the filer again", 1, http.MethodDelete,
+		func(args []string) (string, url.Values) {
+			return "/exclude/" + url.PathEscape(args[0]), nil
+		}),
+	newCmd("drain POD", "Requeue the filer of a worker pod and retire the worker", 1, http.MethodPut,
+		func(args []string) (string, url.Values) {
+			return "/drain/" + url.PathEscape(args[0]), url.Values{"reason": {reason}}
+		}),
+	newCmd("undrain POD", "Undo drain: let the worker pod request a filer again", 1, http.MethodDelete,
+		func(args []string) (string, url.Values) {
+			return "/drain/" + url.PathEscape(args[0]), nil
+		}),
+}
+
+var reason string
+
+func init() {
+	Cmd.AddCommand(cmds...)
+}
+
+func newCmd(use, short string, nargs int, method string, path func([]string) (string, url.Values)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(nargs),
+		PreRun: func(cmd *cobra.Command, _ []string) {
+			viper.BindPFlag("master_url", cmd.Flags().Lookup("master-url"))
+			viper.BindPFlag("admin_token", cmd.Flags().Lookup("admin-token"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, query := path(args)
+			return request(cmd.Context(), method, p, query)
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	cmd.Flags().StringP("master-url", "m", "http://localhost:8080", "The url of the netappsd-master")
+	cmd.Flags().StringP("admin-token", "", "", "The admin token of the master")
+	if strings.HasPrefix(use, "exclude") || strings.HasPrefix(use, "drain") {
+		cmd.Flags().StringVarP(&reason, "reason", "", "", "The reason, shown in the status")
+	}
+	return cmd
+}
+
+func request(ctx context.Context, method, path string, query url.Values) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	u := strings.TrimSuffix(viper.GetString("master_url"), "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, http.NoBody)
+	if err != nil {
+		return err
+	}
+	if token := viper.GetString("admin_token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimSpace(string(b)))
+	}
+	fmt.Println(strings.Trim(strings.TrimSpace(string(b)), `"`))
+	return nil
+}
@@ -0,0 +1,173 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/sapcc/netappsd/cmd/worker"
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+var (
+	templateFilePath string
+	extraTemplates   []string
+	outputFilePath   string
+	region           string
+	labels           map[string]string
+	filer            netbox.Filer
+	filerFile        string
+	masterUrl        string
+	queryCluster     bool
+	validate         bool
+)
+
+var Cmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render the worker templates for a filer offline",
+	Long: `
+Render the worker templates for a filer exactly as the worker does, without
+deploying a worker. The filer is given with the --name, --host, --ip and --az
+flags, read from a JSON file with --filer-file, or fetched by name from the
+discovered filers of a running master with --master-url.`,
+	RunE:          run,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	Cmd.Flags().StringVarP(&templateFilePath, "template-file", "t", "harvest.yaml.tpl", "The path to the template file")
+	Cmd.Flags().StringArrayVarP(&extraTemplates, "extra-template", "", nil, "Additional template rendered relative to the output directory, as template[=output]")
+	Cmd.Flags().StringVarP(&outputFilePath, "output-file", "o", "", "The path to the output file or directory; the harvest config is printed to stdout if empty")
+	Cmd.Flags().StringVarP(&region, "region", "r", "", "The region passed to the template")
+	Cmd.Flags().StringToStringVarP(&labels, "label", "", nil, "Custom labels passed to the template, e.g. --label env=prod")
+	Cmd.Flags().StringVarP(&filer.Name, "name", "n", "", "The name of the filer")
+	Cmd.Flags().StringVarP(&filer.Host, "host", "", "", "The host of the filer")
+	Cmd.Flags().StringVarP(&filer.Ip, "ip", "", "", "The ip address of the filer")
+	Cmd.Flags().StringVarP(&filer.AvailabilityZone, "az", "", "", "The availability zone of the filer")
+	Cmd.Flags().StringVarP(&filerFile, "filer-file", "f", "", "The JSON file to read the filer from")
+	Cmd.Flags().StringVarP(&masterUrl, "master-url", "m", "", "The url of a netappsd-master to fetch the filer given by --name from")
+	Cmd.Flags().BoolVarP(&queryCluster, "query-cluster", "", false, "Query the ONTAP cluster info from the filer")
+	Cmd.Flags().BoolVarP(&validate, "validate", "", false, "Check that the output is a valid harvest config")
+}
+
+func run(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	f := new(worker.NetappsdWorker)
+	f.Region = region
+	f.Labels = labels
+
+	tpl, err := harvest.ParseTemplate(templateFilePath)
+	if err != nil {
+		return err
+	}
+	f.Template = tpl
+	for _, spec := range extraTemplates {
+		extra, err := worker.ParseExtraTemplate(spec)
+		if err != nil {
+			return err
+		}
+		f.ExtraTemplates = append(f.ExtraTemplates, extra)
+	}
+	if err := f.Validate(ctx); err != nil {
+		return err
+	}
+
+	if f.Filer, err = loadFiler(); err != nil {
+		return err
+	}
+	if queryCluster {
+		f.FilerClient = netapp.NewFilerClient(f.Host, viper.GetString("netapp_username"), viper.GetString("netapp_password"))
+	}
+
+	data := f.TemplateData(ctx)
+	b, err := f.Template.Render(data)
+	if err != nil {
+		return err
+	}
+	if validate {
+		if err := harvest.ValidateConfig(b); err != nil {
+			return fmt.Errorf("rendered harvest config is invalid: %w", err)
+		}
+		slog.Info("rendered harvest config is valid")
+	}
+
+	if outputFilePath != "" {
+		return f.Render(ctx, outputFilePath)
+	}
+	os.Stdout.Write(b)
+	for _, extra := range f.ExtraTemplates {
+		b, err := extra.Render(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", extra.OutputFile, err)
+		}
+		fmt.Printf("\n---\n# %s\n", extra.OutputFile)
+		os.Stdout.Write(b)
+	}
+	return nil
+}
+
+// loadFiler returns the filer from the file, the master or the flags, in this
+// order.
+func loadFiler() (netbox.Filer, error) {
+	switch {
+	case filerFile != "":
+		b, err := os.ReadFile(filerFile)
+		if err != nil {
+			return netbox.Filer{}, err
+		}
+		var f netbox.Filer
+		if err := json.Unmarshal(b, &f); err != nil {
+			return netbox.Filer{}, fmt.Errorf("failed to parse %s: %w", filerFile, err)
+		}
+		return f, nil
+	case masterUrl != "":
+		if filer.Name == "" {
+			return netbox.Filer{}, fmt.Errorf("--name is required with --master-url")
+		}
+		return fetchFiler(strings.TrimSuffix(masterUrl, "/")+"/filers", filer.Name)
+	default:
+		if filer.Name == "" || filer.Host == "" {
+			return netbox.Filer{}, fmt.Errorf("--name and --host are required without --filer-file or --master-url")
+		}
+		return filer, nil
+	}
+}
+
+// fetchFiler returns the filer with the given name from the discovered filers
+// of the master.
+func fetchFiler(url, name string) (netbox.Filer, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return netbox.Filer{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return netbox.Filer{}, fmt.Errorf("%s", b)
+	}
+	var filers []netbox.Filer
+	if err := json.NewDecoder(resp.Body).Decode(&filers); err != nil {
+		return netbox.Filer{}, err
+	}
+	for _, f := range filers {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return netbox.Filer{}, fmt.Errorf("filer %s is not discovered by the master", name)
+}
@@ -0,0 +1,108 @@
+package simulate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sapcc/go-bits/httpext"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/sapcc/netappsd/internal/pkg/simulate"
+	"github.com/sapcc/netappsd/internal/pkg/utils"
+)
+
+var (
+	scriptFile string
+	outputJSON bool
+	showSteps  bool
+)
+
+var Cmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Simulate a master against a fake cluster, netbox and ONTAP",
+	Long: `
+Run a master against a fake Kubernetes cluster, whose deployment controller
+creates and deletes worker pods, a scripted filer inventory and an ONTAP stub
+with configurable failures. The script is a timeline of events, e.g. filers
+added or removed, netbox outages, probe failures, killed pods or zones going
+down. The report shows for every phase between events how many steps the
+workers took to converge, the pod churn and the unassigned filers.`,
+	RunE:          run,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	Cmd.Flags().StringVarP(&scriptFile, "script", "s", "", "The simulation script (YAML)")
+	Cmd.Flags().BoolVarP(&outputJSON, "json", "", false, "Print the report as JSON")
+	Cmd.Flags().BoolVarP(&showSteps, "steps", "", false, "Print the state of every step")
+	Cmd.MarkFlagRequired("script")
+}
+
+func run(cmd *cobra.Command, _ []string) error {
+	if !viper.GetBool("debug") {
+		// the master logs every assignment, keep the report readable
+		slog.SetDefault(slog.New(utils.NewHandler(slog.LevelError, false)))
+	}
+	script, err := simulate.LoadScript(scriptFile)
+	if err != nil {
+		return err
+	}
+	ctx := httpext.ContextWithSIGINT(context.Background(), 0)
+	report, err := simulate.Run(ctx, script)
+	if err != nil {
+		return err
+	}
+	if outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return printReport(os.Stdout, report)
+}
+
+func printReport(w io.Writer, report *simulate.Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if showSteps {
+		fmt.Fprintln(tw, "STEP\tREPLICAS\tPODS\tASSIGNED\tDESIRED\tQUEUED\tEXPECTED\tUNASSIGNED\tSTALE\tCREATED\tDELETED\tCONVERGED")
+		for _, s := range report.Steps {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%t\n", s.Step, s.Replicas, s.Pods, s.Assigned,
+				s.Desired, s.Queued, s.Expected, s.Unassigned, s.Stale, s.PodsCreated, s.PodsDeleted, s.Converged)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprintf(tw, "PHASES (step %s)\n", report.Step)
+	fmt.Fprintln(tw, "STEP\tEVENTS\tCONVERGED AFTER\tCREATED\tDELETED\tASSIGNMENTS\tMAX UNASSIGNED\tUNASSIGNED STEPS")
+	total := simulate.Phase{}
+	for _, p := range report.Phases {
+		events := strings.Join(p.Events, ", ")
+		if events == "" {
+			events = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", p.Step, events, convergedAfter(p.ConvergedAfter),
+			p.PodsCreated, p.PodsDeleted, p.Assignments, p.MaxUnassigned, p.UnassignedSteps)
+		total.PodsCreated += p.PodsCreated
+		total.PodsDeleted += p.PodsDeleted
+		total.Assignments += p.Assignments
+		total.MaxUnassigned = max(total.MaxUnassigned, p.MaxUnassigned)
+		total.UnassignedSteps += p.UnassignedSteps
+	}
+	fmt.Fprintf(tw, "total\t\t\t%d\t%d\t%d\t%d\t%d\n", total.PodsCreated, total.PodsDeleted, total.Assignments,
+		total.MaxUnassigned, total.UnassignedSteps)
+	return tw.Flush()
+}
+
+func convergedAfter(steps int) string {
+	if steps < 0 {
+		return "not converged"
+	}
+	return fmt.Sprintf("%d steps", steps)
+}
@@ -0,0 +1,220 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sapcc/go-bits/httpext"
+	"github.com/spf13/cobra"
+
+	"github.com/sapcc/netappsd/internal/netappsd"
+)
+
+var (
+	masterUrl     string
+	filerName     string
+	watch         bool
+	watchInterval time.Duration
+	outputJSON    bool
+)
+
+var Cmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the discovered filers, queue and workers of a running master",
+	Long: `
+Show the state of a running master: discovered filers, the filer queue, worker
+assignments, filers that failed probing and filers without a worker. With
+--filer, explain why a single filer is or is not scraped.`,
+	RunE:          run,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	Cmd.Flags().StringVarP(&masterUrl, "master-url", "m", "http://localhost:8080", "The url of the netappsd-master")
+	Cmd.Flags().StringVarP(&filerName, "filer", "f", "", "Explain the state of a single filer")
+	Cmd.Flags().BoolVarP(&watch, "watch", "w", false, "Print the status repeatedly")
+	Cmd.Flags().DurationVarP(&watchInterval, "interval", "i", 10*time.Second, "The interval of --watch")
+	Cmd.Flags().BoolVarP(&outputJSON, "json", "", false, "Print the raw status as JSON")
+}
+
+func run(cmd *cobra.Command, _ []string) error {
+	ctx := httpext.ContextWithSIGINT(context.Background(), 0)
+	url := strings.TrimSuffix(masterUrl, "/") + "/status"
+
+	for {
+		status, err := fetchStatus(ctx, url)
+		if err != nil && !watch {
+			return err
+		}
+		if watch {
+			// clear the terminal, like watch(1)
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("Every %s: %s\t%s\n\n", watchInterval, url, time.Now().Format(time.RFC1123))
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else if err := printStatus(os.Stdout, status); err != nil {
+			return err
+		}
+		if !watch {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+func fetchStatus(ctx context.Context, url string) (*netappsd.Status, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s", b)
+	}
+	status := new(netappsd.Status)
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func printStatus(w io.Writer, status *netappsd.Status) error {
+	if outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+	if filerName != "" {
+		fmt.Fprintln(w, explainFiler(status, filerName))
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if status.NetboxError != "" {
+		fmt.Fprintf(tw, "NETBOX DEGRADED: %s\n\n", status.NetboxError)
+	}
+
+	fmt.Fprintf(tw, "FILERS (%d)\n", len(status.Filers))
+	fmt.Fprintln(tw, "NAME\tHOST\tAZ\tLAST PROBE\tWORKER")
+	for _, f := range status.Filers {
+		worker := f.Worker
+		if worker == "" {
+			worker = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Name, f.Host, f.AvailabilityZone, since(f.LastProbe), worker)
+	}
+
+	fmt.Fprintf(tw, "\nWORKERS (%d)\n", len(status.Workers))
+	fmt.Fprintln(tw, "POD\tFILER\tPHASE")
+	for _, p := range status.Workers {
+		filer, phase := p.Filer, p.Phase
+		if filer == "" {
+			filer = "-"
+		}
+		if p.Deleting {
+			phase += " (deleting)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Pod, filer, phase)
+	}
+
+	fmt.Fprintf(tw, "\nQUEUE (%d): %s\n", len(status.Queue), strings.Join(status.Queue, ", "))
+	fmt.Fprintf(tw, "UNASSIGNED (%d): %s\n", len(status.Unassigned), strings.Join(status.Unassigned, ", "))
+	fmt.Fprintf(tw, "INACTIVE IN NETBOX (%d): %s\n", len(status.Inactive), strings.Join(status.Inactive, ", "))
+
+	fmt.Fprintf(tw, "\nOVERRIDES\n")
+	printOverrides(tw, "pinned", status.Overrides.Pinned)
+	printOverrides(tw, "excluded", status.Overrides.Excluded)
+	printOverrides(tw, "drained", status.Overrides.Drained)
+
+	fmt.Fprintf(tw, "\nPROBE FAILURES (%d)\n", len(status.ProbeFailures))
+	names := make([]string, 0, len(status.ProbeFailures))
+	for name := range status.ProbeFailures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, status.ProbeFailures[name])
+	}
+	return tw.Flush()
+}
+
+func printOverrides(w io.Writer, kind string, overrides map[string]string) {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", kind, name, overrides[name])
+	}
+}
+
+// explainFiler answers why a filer is or is not scraped.
+func explainFiler(status *netappsd.Status, name string) string {
+	if reason, found := status.Overrides.Excluded[name]; found {
+		return fmt.Sprintf("filer %s is excluded from scraping: %s", name, reason)
+	}
+	for _, p := range status.Workers {
+		if p.Filer == name {
+			if _, drained := status.Overrides.Drained[p.Pod]; drained {
+				return fmt.Sprintf("filer %s is assigned to worker %s, which is drained", name, p.Pod)
+			}
+			if p.Deleting {
+				return fmt.Sprintf("filer %s is assigned to worker %s, which is being deleted", name, p.Pod)
+			}
+			return fmt.Sprintf("filer %s is scraped by worker %s (%s)", name, p.Pod, p.Phase)
+		}
+	}
+	for i, q := range status.Queue {
+		if q == name {
+			if pod, found := status.Overrides.Pinned[name]; found {
+				return fmt.Sprintf("filer %s is queued at position %d of %d, waiting for worker %s it is pinned to", name, i+1, len(status.Queue), pod)
+			}
+			return fmt.Sprintf("filer %s is queued at position %d of %d, waiting for a free worker", name, i+1, len(status.Queue))
+		}
+	}
+	if err, found := status.ProbeFailures[name]; found {
+		return fmt.Sprintf("filer %s is not scraped, because probing failed: %s", name, err)
+	}
+	for _, i := range status.Inactive {
+		if i == name {
+			return fmt.Sprintf("filer %s is not scraped, because it is not active in netbox", name)
+		}
+	}
+	for _, f := range status.Filers {
+		if f.Name == name {
+			return fmt.Sprintf("filer %s is discovered and was last probed %s, but not queued or assigned yet", name, since(f.LastProbe))
+		}
+	}
+	msg := fmt.Sprintf("filer %s is not discovered: it is not in netbox with the master's region and tag", name)
+	if status.NetboxError != "" {
+		msg += fmt.Sprintf(", netbox is unreachable: %s", status.NetboxError)
+	}
+	return msg
+}
+
+func since(t time.Time) string {
+	if t.IsZero() || t.Unix() == 0 {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
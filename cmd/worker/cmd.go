@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,6 +11,8 @@ import (
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/must"
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
 	"github.com/sapcc/netappsd/internal/pkg/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -20,6 +23,10 @@ var (
 	masterUrl        string
 	outputFilePath   string
 	templateFilePath string
+	extraTemplates   []string
+	region           string
+	labels           map[string]string
+	filerJSON        string
 )
 
 var Cmd = &cobra.Command{
@@ -32,20 +39,59 @@ var Cmd = &cobra.Command{
 func init() {
 	Cmd.Flags().StringVarP(&masterUrl, "master-url", "m", "http://localhost:8080", "The url of the netappsd-master")
 	Cmd.Flags().StringVarP(&httpListenAddr, "listen-addr", "l", ":8082", "The address to listen on")
-	Cmd.Flags().StringVarP(&outputFilePath, "output-file", "o", "harvest.yaml", "The path to the output file")
+	Cmd.Flags().StringVarP(&outputFilePath, "output-file", "o", "harvest.yaml", "The path to the output file, or the output directory to write <filer>.yaml to")
 	Cmd.Flags().StringVarP(&templateFilePath, "template-file", "t", "harvest.yaml.tpl", "The path to the template file")
+	Cmd.Flags().StringArrayVarP(&extraTemplates, "extra-template", "", nil, "Additional template rendered relative to the output directory, as template[=output]")
+	Cmd.Flags().StringVarP(&region, "region", "r", "", "The region passed to the template")
+	Cmd.Flags().StringToStringVarP(&labels, "label", "", nil, "Custom labels passed to the template, e.g. --label env=prod")
+	Cmd.Flags().StringVarP(&filerJSON, "filer", "", "", "The filer as JSON; it is not requested from the master if set (env FILER)")
+	viper.BindPFlag("filer", Cmd.Flags().Lookup("filer"))
 }
 
 func run(cmd *cobra.Command, args []string) {
 	slog.Info("Starting netappsd worker")
 	f := new(NetappsdWorker)
+	f.Region = region
+	f.Labels = labels
+	f.MasterURL = masterUrl
+
+	// fail early on broken templates, before a filer is assigned to the worker
+	tpl, err := harvest.ParseTemplate(templateFilePath)
+	if err != nil {
+		slog.Error("failed to parse filer template", "error", err.Error())
+		os.Exit(1)
+	}
+	f.Template = tpl
+	for _, spec := range extraTemplates {
+		extra, err := ParseExtraTemplate(spec)
+		if err != nil {
+			slog.Error("failed to parse extra template", "error", err.Error())
+			os.Exit(1)
+		}
+		f.ExtraTemplates = append(f.ExtraTemplates, extra)
+	}
+	if err := f.Validate(context.Background()); err != nil {
+		slog.Error("failed to validate filer template", "error", err.Error())
+		os.Exit(1)
+	}
 
 	ctx := httpext.ContextWithSIGINT(context.Background(), 0)
 	requestURL := masterUrl + "/next/filer?pod=" + viper.GetString("pod_name")
 	ticker := new(utils.TickTick)
 
+	// in per-filer mode, the master passes the filer in
+	if filerJSON = viper.GetString("filer"); filerJSON != "" {
+		var filer netbox.Filer
+		if err := json.Unmarshal([]byte(filerJSON), &filer); err != nil {
+			slog.Error("invalid filer", "error", err.Error())
+			os.Exit(1)
+		}
+		f.SetFiler(filer)
+		slog.Info("filer set", "filer", f.Name, "host", f.Host)
+	}
+
 REQUESTFILER:
-	for {
+	for f.Name == "" {
 		select {
 		case <-ctx.Done():
 			return
@@ -59,7 +105,7 @@ REQUESTFILER:
 		}
 	}
 
-	if err := f.Render(templateFilePath, outputFilePath); err != nil {
+	if err := f.Render(ctx, outputFilePath); err != nil {
 		slog.Error("failed to render filer template", "error", err.Error())
 		os.Exit(1)
 	}
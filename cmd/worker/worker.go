@@ -1,32 +1,84 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"text/template"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
 	"github.com/sapcc/netappsd/internal/pkg/netapp"
 	"github.com/sapcc/netappsd/internal/pkg/netbox"
+	"github.com/sapcc/netappsd/internal/pkg/utils"
 	"github.com/spf13/viper"
 )
 
 type NetappsdWorker struct {
 	FilerClient *netapp.FilerClient
 	netbox.Filer
+
+	// Template is the harvest config template rendered for the filer.
+	Template *harvest.Template
+	// ExtraTemplates are rendered next to the harvest config, e.g. collector
+	// templates.
+	ExtraTemplates []ExtraTemplate
+	// Region and Labels are passed to the template.
+	Region string
+	Labels map[string]string
+	// MasterURL is the url of the master the filer is refreshed from.
+	MasterURL string
+
+	outputFilePath string
+	mu             sync.Mutex
+}
+
+// ExtraTemplate is a template rendered into the output directory.
+type ExtraTemplate struct {
+	*harvest.Template
+	// OutputFile is the path of the rendered file relative to the output
+	// directory.
+	OutputFile string
+}
+
+// ParseExtraTemplate parses a "template[=output]" flag value. The output
+// defaults to the template file name without the ".tpl" suffix.
+func ParseExtraTemplate(spec string) (ExtraTemplate, error) {
+	templateFile, outputFile, found := strings.Cut(spec, "=")
+	if !found {
+		outputFile = strings.TrimSuffix(filepath.Base(templateFile), ".tpl")
+	}
+	if filepath.IsAbs(outputFile) || strings.HasPrefix(filepath.Clean(outputFile), "..") {
+		return ExtraTemplate{}, fmt.Errorf("output %s of template %s must be relative to the output directory", outputFile, templateFile)
+	}
+	tpl, err := harvest.ParseTemplate(templateFile)
+	if err != nil {
+		return ExtraTemplate{}, err
+	}
+	return ExtraTemplate{Template: tpl, OutputFile: outputFile}, nil
 }
 
 func (f *NetappsdWorker) RequestFiler(url string) error {
 	if err := f.fetch(url); err != nil {
 		return err
 	}
+	f.SetFiler(f.Filer)
+	return nil
+}
+
+// SetFiler sets the filer without requesting it from the master, e.g. when
+// the master runs one worker per filer and passes the filer in.
+func (f *NetappsdWorker) SetFiler(filer netbox.Filer) {
+	f.Filer = filer
 	username := viper.GetString("netapp_username")
 	password := viper.GetString("netapp_password")
 	f.FilerClient = netapp.NewFilerClient(f.Host, username, password)
-	return nil
 }
 
 func (f *NetappsdWorker) fetch(url string) error {
@@ -40,33 +92,168 @@ func (f *NetappsdWorker) fetch(url string) error {
 		b, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("%s", b)
 	}
-	if err = json.NewDecoder(resp.Body).Decode(f); err != nil {
+	if err = json.NewDecoder(resp.Body).Decode(&f.Filer); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (f *NetappsdWorker) Render(templateFilePath, outputFilePath string) error {
-	fo, err := os.Create(outputFilePath)
+// TemplateData returns the data the template is rendered with. The ONTAP
+// cluster information is left empty if the filer can not be queried.
+func (f *NetappsdWorker) TemplateData(ctx context.Context) harvest.TemplateData {
+	data := harvest.TemplateData{
+		Filer: f.Filer,
+		Credentials: harvest.Credentials{
+			Username: viper.GetString("netapp_username"),
+			Password: viper.GetString("netapp_password"),
+		},
+		Region: f.Region,
+		Pod: harvest.Pod{
+			Name:      viper.GetString("pod_name"),
+			Namespace: viper.GetString("pod_namespace"),
+		},
+		Labels: f.Labels,
+	}
+	if data.Labels == nil {
+		data.Labels = make(map[string]string)
+	}
+	if f.FilerClient != nil {
+		if cluster, err := f.FilerClient.GetCluster(ctx); err != nil {
+			slog.Warn("failed to get ontap cluster info", "filer", f.Name, "error", err.Error())
+		} else {
+			data.Cluster = *cluster
+		}
+	}
+	return data
+}
+
+// Validate checks all templates with the data of the worker, so that broken
+// templates fail before a filer is assigned.
+func (f *NetappsdWorker) Validate(ctx context.Context) error {
+	data := f.TemplateData(ctx)
+	if err := f.Template.Validate(data); err != nil {
+		return err
+	}
+	for _, extra := range f.ExtraTemplates {
+		if err := extra.Validate(data); err != nil {
+			return fmt.Errorf("%s: %w", extra.OutputFile, err)
+		}
+	}
+	return nil
+}
+
+// Render renders the harvest config and the extra templates. If outputPath
+// is a directory, the harvest config is written to "<filer name>.yaml" in
+// it, which is the poller name expected by start_poller.sh. Extra templates
+// are written relative to the directory of the harvest config. All files are
+// written atomically, and the harvest config is written last, so that the
+// poller never reads a partial config.
+func (f *NetappsdWorker) Render(ctx context.Context, outputPath string) error {
+	f.outputFilePath = outputPath
+	outputDir, outputFile := outputPaths(outputPath, f.Name)
+	data := f.TemplateData(ctx)
+
+	for _, extra := range f.ExtraTemplates {
+		b, err := extra.Render(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", extra.OutputFile, err)
+		}
+		path := filepath.Join(outputDir, extra.OutputFile)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := utils.WriteFileAtomic(path, b, 0o644); err != nil {
+			return err
+		}
+		slog.Debug("rendered template", "file", path)
+	}
+
+	b, err := f.Template.Render(data)
 	if err != nil {
 		return err
 	}
-	defer fo.Close()
-	tpl, err := template.ParseGlob(templateFilePath)
+	if err := utils.WriteFileAtomic(outputFile, b, 0o644); err != nil {
+		return err
+	}
+	slog.Info("rendered harvest config", "file", outputFile)
+	return nil
+}
+
+// outputPaths returns the output directory and the harvest config file for
+// outputPath, which is either a file or a directory.
+func outputPaths(outputPath, filerName string) (string, string) {
+	if strings.HasSuffix(outputPath, string(filepath.Separator)) {
+		return outputPath, filepath.Join(outputPath, filerName+".yaml")
+	}
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		return outputPath, filepath.Join(outputPath, filerName+".yaml")
+	}
+	return filepath.Dir(outputPath), outputPath
+}
+
+// RefreshFiler fetches the filer details from the master again, e.g. after
+// the filer's address changed in netbox, and renders the template again. The
+// details are only taken from the master, so that a caller of the refresh
+// endpoint can not point the worker and its credentials to another host.
+func (f *NetappsdWorker) RefreshFiler(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Name == "" {
+		return fmt.Errorf("worker has no filer")
+	}
+	url := strings.TrimSuffix(f.MasterURL, "/") + "/filers/" + f.Name
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
 	if err != nil {
 		return err
 	}
-	return tpl.Execute(fo, f)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", b)
+	}
+	var filer netbox.Filer
+	if err := json.NewDecoder(resp.Body).Decode(&filer); err != nil {
+		return err
+	}
+	if filer.Name != f.Name {
+		return fmt.Errorf("master returned filer %s, not %s", filer.Name, f.Name)
+	}
+	f.SetFiler(filer)
+	return f.Render(ctx, f.outputFilePath)
+}
+
+func (f *NetappsdWorker) filerClient() *netapp.FilerClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.FilerClient
 }
 
 func (f *NetappsdWorker) AddTo(r *mux.Router) {
+	r.Methods("POST").Path("/filer/refresh").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := f.RefreshFiler(r.Context()); err != nil {
+				slog.Warn("failed to refresh filer", "error", err.Error())
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			slog.Info("filer refreshed", "filer", f.Name, "host", f.Host)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+		})
+
 	r.Methods("GET").Path("/healthz").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			if f.FilerClient == nil {
+			filerClient := f.filerClient()
+			if filerClient == nil {
 				w.WriteHeader(http.StatusServiceUnavailable)
 				w.Write([]byte("no filer"))
-			} else if err := f.FilerClient.Probe(ctx); err != nil {
+			} else if err := filerClient.Probe(ctx); err != nil {
 				err = fmt.Errorf("failed to probe filer: %s", err)
 				w.WriteHeader(http.StatusServiceUnavailable)
 				w.Write([]byte(err.Error()))
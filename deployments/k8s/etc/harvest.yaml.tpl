@@ -1,8 +1,9 @@
+{{- if ne .Version 1 }}{{ fail "harvest.yaml.tpl requires template version 1" }}{{ end -}}
 Defaults:
   auth_style: basic_auth
   use_insecure_tls: true
-  username: {{ .Username }}
-  password: {{ .Password }}
+  username: {{ .Credentials.Username | quote }}
+  password: {{ .Credentials.Password | quote }}
   exporters:
     - prom
 
@@ -13,14 +14,17 @@ Exporters:
     port: 13000
 
 Pollers:
-  {{ .Name }}:
-    addr: {{ .Host }}
-    datacenter: {{ .AvailabilityZone }}
+  {{ .Filer.Name }}:
+    addr: {{ .Filer.Host }}
+    datacenter: {{ .Filer.AvailabilityZone }}
     labels:
-      - availability_zone: {{ .AvailabilityZone }}
-      - filer: {{ .Name }}
+      - availability_zone: {{ .Filer.AvailabilityZone }}
+      - filer: {{ .Filer.Name }}
+      {{- range $key, $value := .Labels }}
+      - {{ $key }}: {{ $value | quote }}
+      {{- end }}
     collectors:
       - Rest:
         - limited.yaml
       - RestPerf:
-        - limited.yaml
\ No newline at end of file
+        - limited.yaml
@@ -0,0 +1,181 @@
+package netappsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// inventoryDiff is the difference between two filer inventories fetched from
+// netbox.
+type inventoryDiff struct {
+	Added   []netbox.Filer
+	Removed []netbox.Filer
+	Changed []filerChange
+}
+
+// filerChange is a filer whose address or availability zone changed in
+// netbox.
+type filerChange struct {
+	Old netbox.Filer
+	New netbox.Filer
+}
+
+func (c filerChange) String() string {
+	return fmt.Sprintf("host %s -> %s, ip %s -> %s, az %s -> %s",
+		c.Old.Host, c.New.Host, c.Old.Ip, c.New.Ip, c.Old.AvailabilityZone, c.New.AvailabilityZone)
+}
+
+func (d inventoryDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffInventory compares the old and the new inventory by filer name.
+func diffInventory(oldFilers, newFilers []netbox.Filer) inventoryDiff {
+	diff := inventoryDiff{}
+	oldByName := make(map[string]netbox.Filer, len(oldFilers))
+	for _, f := range oldFilers {
+		oldByName[f.Name] = f
+	}
+	newByName := make(map[string]struct{}, len(newFilers))
+	for _, f := range newFilers {
+		newByName[f.Name] = struct{}{}
+		old, found := oldByName[f.Name]
+		if !found {
+			diff.Added = append(diff.Added, f)
+			continue
+		}
+		if old.Host != f.Host || old.Ip != f.Ip || old.AvailabilityZone != f.AvailabilityZone {
+			diff.Changed = append(diff.Changed, filerChange{Old: old, New: f})
+		}
+	}
+	for _, f := range oldFilers {
+		if _, found := newByName[f.Name]; !found {
+			diff.Removed = append(diff.Removed, f)
+		}
+	}
+	return diff
+}
+
+// applyInventoryDiff reports the diff and applies it to the filer list and
+// queue. The workers of changed filers are refreshed by refreshWorkers, and
+// workers of removed filers are retired in the next worker update. It must be
+// called with n.mu held.
+func (n *NetAppSD) applyInventoryDiff(ctx context.Context, diff inventoryDiff) {
+	if diff.IsEmpty() {
+		return
+	}
+	slog.Info("netbox inventory changed", "added", len(diff.Added), "removed", len(diff.Removed), "changed", len(diff.Changed))
+
+	for _, f := range diff.Added {
+		inventoryChanges.WithLabelValues(n.Pool, "added").Inc()
+		delete(n.removedFilers, f.Name)
+		slog.Info("filer added to netbox", "filer", f.Name, "host", f.Host, "ip", f.Ip, "az", f.AvailabilityZone)
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerAdded", "Filer %s added to netbox", f.Name)
+	}
+
+	for _, f := range diff.Removed {
+		inventoryChanges.WithLabelValues(n.Pool, "removed").Inc()
+		slog.Info("filer removed from netbox", "filer", f.Name)
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerRemoved", "Filer %s removed from netbox, retire its worker", f.Name)
+		n.removedFilers[f.Name] = struct{}{}
+		delete(n.filerList, f.Name)
+		n.lastProbeFilerTs.Delete(f.Name)
+		delete(n.probeErrors, f.Name)
+		n.removeFromQueue(f.Name)
+	}
+
+	for _, c := range diff.Changed {
+		inventoryChanges.WithLabelValues(n.Pool, "changed").Inc()
+		slog.Info("filer changed in netbox", "filer", c.New.Name, "change", c.String())
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerChanged", "Filer %s changed in netbox: %s", c.New.Name, c)
+		if _, found := n.filerList[c.New.Name]; found {
+			n.filerList[c.New.Name] = Filer(c.New)
+		}
+		for i := range n.filerQueue {
+			if n.filerQueue[i].Name == c.New.Name {
+				n.filerQueue[i] = Filer(c.New)
+			}
+		}
+		n.changedFilers = append(n.changedFilers, c.New.Name)
+	}
+}
+
+func (n *NetAppSD) removeFromQueue(filerName string) {
+	queue := n.filerQueue[:0]
+	for _, f := range n.filerQueue {
+		if f.Name != filerName {
+			queue = append(queue, f)
+		}
+	}
+	n.filerQueue = queue
+}
+
+// refreshWorkers asks the workers of the filers that changed in netbox to
+// fetch their filer from the master again, so that they render their exporter
+// config again. It must be called without n.mu held, since the workers may
+// take a while to answer.
+func (n *NetAppSD) refreshWorkers(ctx context.Context) {
+	n.mu.Lock()
+	changed := n.changedFilers
+	n.changedFilers = nil
+	n.mu.Unlock()
+
+	for _, filerName := range changed {
+		if err := n.refreshWorker(ctx, filerName); err != nil {
+			slog.Warn("failed to refresh worker of changed filer", "filer", filerName, "error", err)
+			n.recordDeploymentEvent(ctx, v1.EventTypeWarning, "WorkerRefreshFailed", "Failed to refresh worker of changed filer %s: %s", filerName, err)
+		}
+	}
+}
+
+// refreshWorker asks the worker pods labelled with the filer to fetch it
+// from the master again. The filer is not sent along, so that nobody can
+// point a worker, and its NetApp credentials, to another host.
+func (n *NetAppSD) refreshWorker(ctx context.Context, filerName string) error {
+	pods, err := n.listWorkerPods(ctx, "filer="+filerName)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if n.DryRun {
+			n.planAction("refresh worker", pod.Name, "filer %s changed in netbox", filerName)
+			continue
+		}
+		url := fmt.Sprintf("http://%s:%d/filer/refresh", pod.Status.PodIP, n.WorkerPort)
+		if err := post(ctx, url); err != nil {
+			return fmt.Errorf("pod %s: %w", pod.Name, err)
+		}
+		slog.Info("refreshed worker of changed filer", "filer", filerName, "pod", pod.Name)
+	}
+	return nil
+}
+
+func post(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP code=%d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
@@ -4,14 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
 	"github.com/sapcc/netappsd/internal/pkg/netapp"
 	"github.com/sapcc/netappsd/internal/pkg/netbox"
 	"github.com/sapcc/netappsd/internal/pkg/utils"
@@ -20,24 +27,118 @@ import (
 type Filer netbox.Filer
 
 type NetAppSD struct {
+	// Pool labels the metrics of the master, e.g. with the namespace and
+	// name of the pool in controller mode.
+	Pool string
+
 	NetboxHost     string
 	NetboxToken    string
+	NetboxOptions  *netbox.ClientOptions
 	Namespace      string
 	Region         string
 	FilerTag       string
 	WorkerName     string
 	WorkerLabel    string
+	WorkerPort     int
 	NetAppUsername string
 	NetAppPassword string
+	InventoryFile  string
+
+	// OverridesConfigMap is the ConfigMap the manual overrides are
+	// persisted in.
+	OverridesConfigMap string
+
+	// DiscoveryDebounce is the time to wait for further changes after a
+	// discovery is triggered, before the discovery runs.
+	DiscoveryDebounce time.Duration
+
+	// DiscoveryInterval and UpdateInterval are the intervals of the filer
+	// discovery and the worker update. They default to 5 minutes and 30
+	// seconds.
+	DiscoveryInterval time.Duration
+	UpdateInterval    time.Duration
+
+	// MinReplicas and MaxReplicas limit the replicas of the worker
+	// deployment; 0 means no limit.
+	MinReplicas int32
+	MaxReplicas int32
+	// MaxScaleUp and MaxScaleDown limit the replicas added or removed in one
+	// update; 0 means no limit.
+	MaxScaleUp   int32
+	MaxScaleDown int32
+	// ScaleUpCooldown is the time after a scale up before the next scale up.
+	// ScaleDownCooldown is the time after any scaling before a scale down.
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+
+	// WorkerMode is WorkerModeShared or WorkerModePerFiler. It defaults to
+	// WorkerModeShared.
+	WorkerMode string
+
+	// Replicas is ReplicasMaster or ReplicasExternal. It defaults to
+	// ReplicasMaster.
+	Replicas string
+
+	// Retire is the retirement strategy of the workers in shared worker
+	// mode, RetireDeletionCost or RetireEvict. It defaults to
+	// RetireDeletionCost.
+	Retire string
+
+	// QueuePolicy orders the filer queue in shared worker mode.
+	QueuePolicy QueuePolicy
+
+	// Rebalance moves filers to free workers in the availability zone of the
+	// filer, one at a time and at most one per RebalanceInterval, which
+	// defaults to 10 minutes.
+	Rebalance         bool
+	RebalanceInterval time.Duration
+
+	// DryRun runs discovery, queue building and retirement selection, but
+	// only plans the changes to pods, deployments, secrets and the overrides
+	// ConfigMap, see Plan.
+	DryRun bool
+
+	// ConfigTemplate returns the harvest config template, if the master
+	// renders the config of the per-filer deployments. The config is
+	// rendered with ConfigLabels into a secret per filer, which replaces the
+	// volume ConfigVolume of the worker deployment.
+	ConfigTemplate func(context.Context) (*harvest.Template, error)
+	ConfigLabels   map[string]string
+	ConfigVolume   string
 
 	filerList        map[string]Filer
 	filerQueue       []Filer
+	unassignedSince  map[string]time.Time
+	move             *filerMove
+	lastMove         time.Time
+	nodeZones        map[string]string
 	lastProbeError   error
 	lastProbeFilerTs SyncMapTimestamp
 	inactiveFilers   map[string]struct{}
-
-	netboxClient  *netbox.Client
-	kubeClientset *kubernetes.Clientset
+	removedFilers    map[string]struct{}
+	changedFilers    []string
+	probeErrors      map[string]string
+	clusters         map[string]netapp.Cluster
+	scaling          Scaling
+	lastScaleUp      time.Time
+	lastScaleDown    time.Time
+	plan             []PlannedAction
+	planMu           sync.Mutex
+	overrides        Overrides
+	inventory        *inventoryCache
+	netboxError      atomic.Pointer[error]
+	deploymentRef    atomic.Pointer[v1.ObjectReference]
+	pods             workerPods
+	discovered       atomic.Bool
+	initialized      bool
+	queue            workqueue.RateLimitingInterface
+	wg               sync.WaitGroup
+
+	filerSource   FilerSource
+	ontap         Ontap
+	kubeClientset kubernetes.Interface
+	recorder      record.EventRecorder
+	broadcaster   record.EventBroadcaster
 	mu            sync.Mutex
 }
 
@@ -54,94 +155,195 @@ func (m *SyncMapTimestamp) Store(key string, value int64) {
 	m.Map.Store(key, value)
 }
 
-// Run starts the netappsd service discovery. It runs a goroutine to discover
-// the filers and update the filer queue every 5 minutes. It also sets the
-// replicas of the worker deployment to the number of filers.
-func (n *NetAppSD) Run(ctx context.Context) error {
-	if netboxClient, err := netbox.NewClient(n.NetboxHost, n.NetboxToken); err != nil {
+// Run starts the netappsd service discovery. It discovers the filers every
+// DiscoveryInterval, or after a discovery is triggered, and updates the filer
+// queue and the workers every UpdateInterval, after a discovery and after
+// changes of the worker pods, see startReconcile. The options replace the
+// clients Run creates otherwise; they are ignored if the master was created
+// with New.
+func (n *NetAppSD) Run(ctx context.Context, opts ...Option) error {
+	if !n.initialized {
+		if err := n.init(ctx, opts...); err != nil {
+			return err
+		}
+	}
+	n.startReconcile(ctx)
+	return nil
+}
+
+// New validates the config of the master and initializes its clients, which
+// the options replace, and its state, but unlike Run it does not start the
+// reconciles, e.g. to test the master with a fake Kubernetes client.
+func New(ctx context.Context, n *NetAppSD, opts ...Option) (*NetAppSD, error) {
+	if err := n.init(ctx, opts...); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *NetAppSD) init(ctx context.Context, opts ...Option) error {
+	switch n.WorkerMode {
+	case "":
+		n.WorkerMode = WorkerModeShared
+	case WorkerModeShared, WorkerModePerFiler:
+	default:
+		return fmt.Errorf("unknown worker mode %s", n.WorkerMode)
+	}
+	if n.ConfigTemplate != nil && n.WorkerMode != WorkerModePerFiler {
+		return fmt.Errorf("the master renders the config only in %s worker mode", WorkerModePerFiler)
+	}
+	if n.Replicas == "" {
+		n.Replicas = ReplicasMaster
+	}
+	if err := validateReplicas(n.Replicas); err != nil {
 		return err
-	} else {
-		n.netboxClient = &netboxClient
 	}
-	if clientset, err := utils.NewKubeClient(); err != nil {
+	if n.Retire == "" {
+		n.Retire = RetireDeletionCost
+	}
+	if err := validateRetire(n.Retire); err != nil {
 		return err
-	} else {
+	}
+	if n.ConfigVolume == "" {
+		n.ConfigVolume = "shared"
+	}
+	if n.DiscoveryInterval == 0 {
+		n.DiscoveryInterval = 5 * time.Minute
+	}
+	if n.UpdateInterval == 0 {
+		n.UpdateInterval = 30 * time.Second
+	}
+	if n.RebalanceInterval == 0 {
+		n.RebalanceInterval = 10 * time.Minute
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.filerSource == nil {
+		netboxClient, err := netbox.NewClient(n.NetboxHost, n.NetboxToken, n.NetboxOptions)
+		if err != nil {
+			return err
+		}
+		n.filerSource = netboxClient
+	}
+	if n.ontap == nil {
+		n.ontap = ontapClient{username: n.NetAppUsername, password: n.NetAppPassword}
+	}
+	if n.kubeClientset == nil {
+		clientset, err := utils.NewKubeClient()
+		if err != nil {
+			return err
+		}
 		n.kubeClientset = clientset
 	}
+	if n.DryRun {
+		// discard the events of planned actions
+		n.recorder = &record.FakeRecorder{}
+	} else {
+		n.recorder, n.broadcaster = newEventRecorder(n.kubeClientset, n.Namespace)
+	}
+	if err := n.loadOverrides(ctx); err != nil {
+		return err
+	}
 
 	n.lastProbeFilerTs = SyncMapTimestamp{}
 	n.filerList = make(map[string]Filer)
 	n.filerQueue = make([]Filer, 0)
-	discoveryDone := make(chan struct{})
+	n.unassignedSince = make(map[string]time.Time)
+	n.nodeZones = make(map[string]string)
 	n.inactiveFilers = make(map[string]struct{})
+	n.removedFilers = make(map[string]struct{})
+	n.probeErrors = make(map[string]string)
+	n.clusters = make(map[string]netapp.Cluster)
+	n.inventory = newInventoryCache(n.InventoryFile, n.Pool)
+	if err := n.inventory.Load(); err != nil {
+		slog.Warn("failed to load inventory file", "file", n.InventoryFile, "error", err)
+	}
+	n.initialized = true
+	return nil
+}
 
-	go func() {
-		defer close(discoveryDone)
-		tick := new(utils.TickTick)
-
-		for {
-			select {
-			case <-tick.Every(5 * time.Minute):
-			case <-ctx.Done():
-				return
-			}
-			success := 0
-			failed := 0
-			success, failed, n.lastProbeError = n.discoverFilers(ctx)
-			if n.lastProbeError != nil {
-				slog.Warn("filer discovery failed", "error", n.lastProbeError)
-			} else {
-				slog.Info("filer discovery done", "success", success, "failed", failed)
-				discoveryDone <- struct{}{}
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-discoveryDone: // update worker replicas after filer discovery
-			case <-time.After(30 * time.Second): // update worker replicas every 30 seconds
-			case <-ctx.Done():
-				return
-			}
-			if err := n.updateWorkerReplica(ctx); err != nil {
-				slog.Error("update worker replicas failed", "error", err)
-			}
-		}
-	}()
+// TriggerDiscovery requests a filer discovery outside of the regular
+// interval, after DiscoveryDebounce to wait for related changes to settle.
+// Triggers that arrive while a discovery is pending are merged.
+func (n *NetAppSD) TriggerDiscovery(source string) {
+	if n.queue == nil {
+		return
+	}
+	discoveryTriggers.WithLabelValues(n.Pool, source).Inc()
+	slog.Info("filer discovery triggered", "source", source)
+	n.queue.AddAfter(reconcileDiscovery, n.DiscoveryDebounce)
+}
 
-	return nil
+// TriggerFilerDiscovery requests a discovery of the named filer only, after
+// DiscoveryDebounce, see discoverFiler.
+func (n *NetAppSD) TriggerFilerDiscovery(source, filerName string) {
+	if n.queue == nil {
+		return
+	}
+	discoveryTriggers.WithLabelValues(n.Pool, source).Inc()
+	slog.Info("filer discovery triggered", "source", source, "filer", filerName)
+	n.queue.AddAfter(reconcileFilerPrefix+filerName, n.DiscoveryDebounce)
 }
 
 // NextFiler returns the next filer in queue and sets the filer label on the
-// worker pod. It returns error if there are no filers in the queue or if the
-// filer label could not be set on the worker pod. The filer queue is updated
-// only when the filer label is set successfully.
+// worker pod. A filer pinned to the pod is returned first, and filers pinned
+// to other pods are skipped. It returns error if the pod is drained, if there
+// are no filers in the queue for the pod or if the filer label could not be
+// set on the worker pod. The filer queue is updated only when the filer label
+// is set successfully.
 func (n *NetAppSD) NextFiler(ctx context.Context, podName string) (*Filer, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	if n.WorkerMode == WorkerModePerFiler {
+		return nil, errPerFilerMode
+	}
+	if n.DryRun {
+		return nil, fmt.Errorf("dry run: filers are not assigned")
+	}
+	if reason, found := n.overrides.Drained[podName]; found {
+		return nil, fmt.Errorf("pod is drained: %s", reason)
+	}
+
 	// Remove filer label; pod restart may leave stale request. Filer request implies no active work.
 	if err := n.clearFilerLabelForPod(ctx, podName); err != nil {
 		return nil, err
 	}
 
-	if len(n.filerQueue) == 0 {
+	if filer, found := n.movedFiler(podName); found {
+		if err := n.setFilerLabelForPod(ctx, podName, filer.Name); err != nil {
+			return nil, err
+		}
+		return &filer, nil
+	}
+
+	next := -1
+	for i, filer := range n.filerQueue {
+		pinnedPod, pinned := n.overrides.Pinned[filer.Name]
+		if pinned && pinnedPod == podName {
+			next = i
+			break
+		}
+		if !pinned && next < 0 {
+			next = i
+		}
+	}
+	if next < 0 {
 		return nil, fmt.Errorf("no filer to work on")
 	}
 
 	// Set filer label; remove filer from queue on success.
-	nextFiler := n.filerQueue[0]
+	nextFiler := n.filerQueue[next]
 	if err := n.setFilerLabelForPod(ctx, podName, nextFiler.Name); err != nil {
 		return nil, err
 	}
-	n.filerQueue = n.filerQueue[1:]
+	n.filerQueue = append(n.filerQueue[:next:next], n.filerQueue[next+1:]...)
 
 	// Update enqueued filer metrics
-	enqueuedFiler.Reset()
+	enqueuedFiler.DeletePartialMatch(prometheus.Labels{"pool": n.Pool})
 	for _, filer := range n.filerQueue {
-		enqueuedFiler.WithLabelValues(filer.Name, filer.Host, filer.Ip).Set(1)
+		enqueuedFiler.WithLabelValues(n.Pool, filer.Name, filer.Host, filer.Ip).Set(1)
 	}
 	slog.Info("next filer for worker", "filer", nextFiler.Name, "pod", podName)
 	return &nextFiler, nil
@@ -152,12 +354,18 @@ func (n *NetAppSD) setFilerLabelForPod(ctx context.Context, podName, value strin
 	if err != nil {
 		return fmt.Errorf("failed to get pod: %s", err)
 	}
+	if n.DryRun {
+		n.planAction("label pod", podName, "filer=%s", value)
+		return nil
+	}
 	slog.Info("set pod label", "filer", value, "pod", podName)
 	pod.Labels["filer"] = value
-	_, err = n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+	updated, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to update pod: %s", err)
 	}
+	n.assumePod(updated)
+	n.recorder.Eventf(pod, v1.EventTypeNormal, "FilerAssigned", "Assigned filer %s to worker", value)
 	return nil
 }
 
@@ -166,24 +374,65 @@ func (n *NetAppSD) clearFilerLabelForPod(ctx context.Context, podName string) er
 	if err != nil {
 		return fmt.Errorf("failed to get pod: %s", err)
 	}
-	if _, found := pod.Labels["filer"]; found {
+	if filerName, found := pod.Labels["filer"]; found && n.DryRun {
+		n.planAction("unlabel pod", podName, "filer=%s", filerName)
+	} else if found {
 		slog.Info("delete filer label from pod", "pod", podName)
 		delete(pod.Labels, "filer")
-		_, err = n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		updated, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
 		if err != nil {
 			return fmt.Errorf("failed to update pod: %s", err)
 		}
+		n.assumePod(updated)
+		n.recorder.Eventf(pod, v1.EventTypeNormal, "FilerUnassigned", "Removed filer %s from worker", filerName)
 	}
 	return nil
 }
 
+// Filers returns the discovered filers sorted by name.
+func (n *NetAppSD) Filers() []Filer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	filers := make([]Filer, 0, len(n.filerList))
+	for _, f := range n.filerList {
+		filers = append(filers, f)
+	}
+	sort.Slice(filers, func(i, j int) bool { return filers[i].Name < filers[j].Name })
+	return filers
+}
+
+// Filer returns the discovered filer with the name.
+func (n *NetAppSD) Filer(name string) (Filer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, found := n.filerList[name]
+	return f, found
+}
+
 func (n *NetAppSD) IsReady() bool {
 	return len(n.filerList) > 0
 }
 
-// discoverFilers queries netbox for filers and updates their timestamps.
+// Discovered reports whether a full discovery has completed since the start
+// of the master. Until then, the filers of the workers may not be probed yet,
+// so that no worker is retired.
+func (n *NetAppSD) Discovered() bool {
+	return n.discovered.Load()
+}
+
+// NetboxError returns the error of the last netbox query, if netbox was not
+// reachable and the filers are probed from the last known inventory.
+func (n *NetAppSD) NetboxError() error {
+	if err := n.netboxError.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// discoverFilers queries netbox for filers, applies the changes since the
+// last query and updates their timestamps.
 func (n *NetAppSD) discoverFilers(ctx context.Context) (int, int, error) {
-	filers, err := n.netboxClient.GetFilers(ctx, n.Region, n.FilerTag)
+	filers, diff, err := n.fetchFilers(ctx)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -191,11 +440,17 @@ func (n *NetAppSD) discoverFilers(ctx context.Context) (int, int, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// probe filer in parallel
+	if diff != nil {
+		n.applyInventoryDiff(ctx, *diff)
+	}
+
+	// probe filer in parallel; mapMu guards the maps written by the probes
 	wg := sync.WaitGroup{}
+	mapMu := sync.Mutex{}
+	clusters := make(map[string]netapp.Cluster)
 	successCounter := atomic.Int32{}
 	failedCounter := atomic.Int32{}
-	discoveredFiler.Reset()
+	discoveredFiler.DeletePartialMatch(prometheus.Labels{"pool": n.Pool})
 
 	for _, f := range filers {
 		if f.Status != "active" {
@@ -206,45 +461,190 @@ func (n *NetAppSD) discoverFilers(ctx context.Context) (int, int, error) {
 			delete(n.inactiveFilers, f.Name)
 		}
 
+		_, hasCluster := n.clusters[f.Name]
 		wg.Add(1)
 
-		go func(filer Filer) {
-			ctx, fn := context.WithTimeout(ctx, 60*time.Second)
-			defer fn()
+		go func(filer Filer, needCluster bool) {
 			defer wg.Done()
-
-			if err := n.probeFiler(ctx, filer); err != nil {
+			err := n.probeFiler(ctx, filer)
+			var cluster *netapp.Cluster
+			if err != nil {
 				failedCounter.Add(1)
-				probeFilerErrors.WithLabelValues(filer.Name, filer.Host, filer.Ip).Inc()
-				slog.Warn("filer probe failed", "filer", filer.Name, "error", err, "timeout", 60)
-				return
+			} else {
+				successCounter.Add(1)
+				if needCluster {
+					cluster = n.getCluster(ctx, filer)
+				}
 			}
-
-			successCounter.Add(1)
-			discoveredFiler.WithLabelValues(filer.Name, filer.Host, filer.Ip).Set(1)
-
-			// initialize filer list if not exists
-			if _, found := n.filerList[filer.Name]; !found {
-				slog.Info("new filer discovered", "filer", filer.Name)
-				n.filerList[filer.Name] = filer
+			mapMu.Lock()
+			defer mapMu.Unlock()
+			n.recordProbe(ctx, filer, err)
+			if cluster != nil {
+				clusters[filer.Name] = *cluster
 			}
-			// update filer probing timestamp
-			n.lastProbeFilerTs.Store(filer.Name, time.Now().Unix())
-		}(Filer(f))
+		}(Filer(f), n.ConfigTemplate != nil && !hasCluster)
 	}
 
 	wg.Wait()
+	for filerName, cluster := range clusters {
+		n.clusters[filerName] = cluster
+	}
 	return int(successCounter.Load()), int(failedCounter.Load()), nil
 }
 
+// recordProbe records the result of probing the filer. A filer that passed
+// probing is added to the filer list. It must be called with n.mu held.
+func (n *NetAppSD) recordProbe(ctx context.Context, filer Filer, err error) {
+	if err != nil {
+		probeFilerErrors.WithLabelValues(n.Pool, filer.Name, filer.Host, filer.Ip).Inc()
+		slog.Warn("filer probe failed", "filer", filer.Name, "error", err, "timeout", probeTimeout)
+		n.recordDeploymentEvent(ctx, v1.EventTypeWarning, "FilerProbeFailed", "Probing filer %s failed: %s", filer.Name, err)
+		n.probeErrors[filer.Name] = err.Error()
+		return
+	}
+
+	discoveredFiler.WithLabelValues(n.Pool, filer.Name, filer.Host, filer.Ip).Set(1)
+	delete(n.probeErrors, filer.Name)
+
+	// initialize filer list if not exists
+	if _, found := n.filerList[filer.Name]; !found {
+		slog.Info("new filer discovered", "filer", filer.Name)
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerDiscovered", "Discovered filer %s", filer.Name)
+		n.filerList[filer.Name] = filer
+	}
+	// update filer probing timestamp
+	n.lastProbeFilerTs.Store(filer.Name, time.Now().Unix())
+}
+
+// discoverFiler fetches a single filer from netbox and probes it, e.g. after
+// a netbox webhook. Changed netbox objects that are not filers, e.g. the
+// nodes whose addresses the filers use, trigger a full discovery instead, as
+// does a failed netbox query or a missing first discovery.
+func (n *NetAppSD) discoverFiler(ctx context.Context, filerName string) error {
+	lastFilers, updated := n.inventory.Get()
+	if updated.IsZero() {
+		n.queue.Add(reconcileDiscovery)
+		return nil
+	}
+	filer, err := n.filerSource.GetFiler(ctx, n.Region, n.FilerTag, filerName)
+	if err != nil {
+		slog.Warn("failed to fetch filer, run a full discovery", "filer", filerName, "error", err)
+		n.queue.Add(reconcileDiscovery)
+		return nil
+	}
+
+	filers := make([]netbox.Filer, 0, len(lastFilers)+1)
+	known := false
+	for _, f := range lastFilers {
+		if f.Name != filerName {
+			filers = append(filers, f)
+		} else {
+			known = true
+		}
+	}
+	if filer == nil && !known {
+		slog.Info("changed netbox object is not a filer, run a full discovery", "name", filerName)
+		n.queue.Add(reconcileDiscovery)
+		return nil
+	}
+	if filer != nil {
+		filers = append(filers, *filer)
+	}
+
+	// probe before locking, a filer may take long to answer
+	var (
+		probeErr error
+		cluster  *netapp.Cluster
+	)
+	if filer != nil && filer.Status == "active" {
+		probeErr = n.probeFiler(ctx, Filer(*filer))
+		if probeErr == nil && n.ConfigTemplate != nil {
+			cluster = n.getCluster(ctx, Filer(*filer))
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.applyInventoryDiff(ctx, diffInventory(lastFilers, filers))
+	if err := n.inventory.Store(filers); err != nil {
+		slog.Warn("failed to write inventory file", "file", n.InventoryFile, "error", err)
+	}
+	if filer != nil {
+		if filer.Status != "active" {
+			n.inactiveFilers[filer.Name] = struct{}{}
+			slog.Info("filer's status is not active in Netbox", "filer", filer.Name, "status", filer.Status)
+		} else {
+			delete(n.inactiveFilers, filer.Name)
+			n.recordProbe(ctx, Filer(*filer), probeErr)
+			if cluster != nil {
+				n.clusters[filer.Name] = *cluster
+			}
+		}
+	}
+	slog.Info("filer discovery done", "filer", filerName, "found", filer != nil, "error", probeErr)
+	n.queue.Add(reconcileWorkers)
+	return nil
+}
+
+// fetchFilers returns the filers from netbox and their difference to the
+// last known inventory, and caches them. The difference is nil if there is no
+// previous inventory to compare with. When netbox is unreachable, it returns
+// the last known inventory instead and marks the discovery as degraded. It
+// returns an error only if there is no inventory to fall back to.
+func (n *NetAppSD) fetchFilers(ctx context.Context) ([]netbox.Filer, *inventoryDiff, error) {
+	filers, err := n.filerSource.GetFilers(ctx, n.Region, n.FilerTag)
+	if err == nil {
+		n.netboxError.Store(nil)
+		netboxDegraded.WithLabelValues(n.Pool).Set(0)
+		var diff *inventoryDiff
+		if lastFilers, updated := n.inventory.Get(); !updated.IsZero() {
+			d := diffInventory(lastFilers, filers)
+			diff = &d
+		}
+		if err := n.inventory.Store(filers); err != nil {
+			slog.Warn("failed to write inventory file", "file", n.InventoryFile, "error", err)
+		}
+		return filers, diff, nil
+	}
+
+	n.netboxError.Store(&err)
+	cachedFilers, updated := n.inventory.Get()
+	if updated.IsZero() {
+		return nil, nil, err
+	}
+	netboxDegraded.WithLabelValues(n.Pool).Set(1)
+	slog.Warn("netbox query failed, use last known inventory", "error", err, "updated", updated, "filers", len(cachedFilers))
+	return cachedFilers, nil, nil
+}
+
+// probeTimeout is the time a filer has to answer a probe.
+const probeTimeout = 60 * time.Second
+
+// probeStaleness is the age of the last successful probe of a filer after
+// which it is not assigned to a worker: the filers are probed every
+// DiscoveryInterval, and the probes of a discovery may take probeTimeout.
+func (n *NetAppSD) probeStaleness() time.Duration {
+	return n.DiscoveryInterval + probeTimeout
+}
+
+// probeFiler probes the filer with a timeout of probeTimeout.
 func (n *NetAppSD) probeFiler(ctx context.Context, filer Filer) error {
-	filerAddress := filer.Ip
-	if filer.Ip == "" {
-		filerAddress = filer.Host
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	slog.Debug("probing filer", "filer", filer.Name, "host", filer.Host, "ip", filer.Ip)
+	return n.ontap.Probe(ctx, netbox.Filer(filer))
+}
+
+// getCluster returns the ONTAP cluster information of the filer for the
+// rendered config, or nil if it can not be queried within 10 seconds. It is
+// queried during discovery, so failures are retried with the next one.
+func (n *NetAppSD) getCluster(ctx context.Context, filer Filer) *netapp.Cluster {
+	cluster, err := n.ontap.GetCluster(ctx, netbox.Filer(filer))
+	if err != nil {
+		slog.Warn("failed to get ontap cluster info", "filer", filer.Name, "error", err)
+		return nil
 	}
-	slog.Debug("probing filer", "filer", filer.Name, "addr", filerAddress)
-	c := netapp.NewFilerClient(filerAddress, n.NetAppUsername, n.NetAppPassword)
-	return c.Probe(ctx)
+	return cluster
 }
 
 // updateWorkerReplica updates the worker replicas based on the current state of the system.
@@ -255,35 +655,75 @@ func (n *NetAppSD) updateWorkerReplica(ctx context.Context) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	cntFreeWorkers, filerInWorkers, err := n.getWorkerDetails(ctx)
+	cntDrainedWorkers, filerInWorkers, err := n.getWorkerDetails(ctx)
 	if err != nil {
 		return err
 	}
 
 	// update queue
-	n.updateFilerQueue(filerInWorkers)
+	n.updateFilerQueue(ctx, filerInWorkers)
+	n.updateUnassigned(filerInWorkers)
+	n.sortFilerQueue()
 
 	// update filer queue metrics
-	enqueuedFiler.Reset()
+	enqueuedFiler.DeletePartialMatch(prometheus.Labels{"pool": n.Pool})
 	for _, filer := range n.filerQueue {
-		enqueuedFiler.WithLabelValues(filer.Name, filer.Host, filer.Ip).Set(1)
+		enqueuedFiler.WithLabelValues(n.Pool, filer.Name, filer.Host, filer.Ip).Set(1)
 	}
 
-	// increase worker replicas if more workers are needed
-	if len(n.filerQueue) > cntFreeWorkers {
-		slog.Info("more workers needed", "freeWorkers", cntFreeWorkers, "queue", len(n.filerQueue))
-		if err := n.scaleUpWorkers(ctx, len(n.filerQueue)-cntFreeWorkers); err != nil {
-			slog.Warn("scale up worker replicas failed", "error", err)
+	n.updateScaling(filerInWorkers)
+	if n.DryRun {
+		n.resetPlan()
+		if err := n.planAssignments(ctx); err != nil {
 			return err
 		}
 	}
 
+	if n.Rebalance {
+		if err := n.rebalance(ctx); err != nil {
+			slog.Warn("rebalance failed", "error", err)
+		}
+	}
+
+	// Scale up to the workers needed: the desired workers plus the drained
+	// ones, which keep their replica until they are deleted. The target is
+	// absolute, so that the updates triggered by pod events do not add
+	// workers for the same queued filers again.
+	if n.Replicas == ReplicasExternal {
+		slog.Debug("worker replicas are managed externally", "desired", n.scaling.Desired)
+	} else if err := n.scaleUpWorkers(ctx, n.scaling.Desired+cntDrainedWorkers); err != nil {
+		slog.Warn("scale up worker replicas failed", "error", err)
+		return err
+	}
+
+	// Do not retire workers before the first full discovery, e.g. after a
+	// restart, since their filers are not known yet.
+	if !n.Discovered() {
+		slog.Info("skip worker retirement, filers not discovered yet")
+		return nil
+	}
+
+	// Evicted workers are gone, the replicas are lowered so that they are
+	// not replaced.
+	if n.Retire == RetireEvict {
+		cnt, err := n.evictWorkers(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Replicas == ReplicasExternal {
+			return nil
+		}
+		return n.scaleDownWorkers(ctx, cnt)
+	}
+
 	// We will skip deleting inactive workers ONLY if the queue is not empty.
 	// Because we can not delete specific workers, we can only scale down the deployment.
 	// If we scale down the deployment while there are workers waiting in the queue, we might lose them.
+	// Workers of removed filers are deleted right away instead; their
+	// replacements take the queued filers.
 	if len(n.filerQueue) > 0 {
 		slog.Info("skip worker retirement", "queue", len(n.filerQueue))
-		return nil
+		return n.deleteRetiredWorkers(ctx)
 	}
 
 	// Retire inactive workers. We set the worker pod deletion cost to -999 to mark it for deletion.
@@ -291,31 +731,37 @@ func (n *NetAppSD) updateWorkerReplica(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if n.Replicas == ReplicasExternal {
+		// the autoscaler deletes the marked workers first
+		return nil
+	}
 	return n.scaleDownWorkers(ctx, cnt)
 }
 
-// getWorkerDetails returns the number of free workers and a map of filers that
-// are being worked on.
+// getWorkerDetails returns the number of drained workers that are not
+// terminating yet and a map of filers that are being worked on. It also
+// prunes the overrides of workers that are gone.
 func (n *NetAppSD) getWorkerDetails(ctx context.Context) (int, map[string]struct{}, error) {
 	workers := make(map[string]struct{})
-	pods, err := n.kubeClientset.CoreV1().Pods(n.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: n.WorkerLabel,
-	})
+	pods, err := n.listWorkerPods(ctx)
 	if err != nil {
 		return 0, nil, err
 	}
-	for _, pod := range pods.Items {
+	n.pruneOverrides(ctx, pods)
+	drainedWorkers := 0
+	for _, pod := range pods {
 		if filerName, found := pod.Labels["filer"]; found {
 			workers[filerName] = struct{}{}
+		} else if _, found := n.overrides.Drained[pod.Name]; found && pod.DeletionTimestamp == nil {
+			drainedWorkers++
 		}
 	}
-	freeWorkers := len(pods.Items) - len(workers)
-	return freeWorkers, workers, nil
+	return drainedWorkers, workers, nil
 }
 
 // updateFilerQueue appends filer queue with filers that are not being worked
 // on. It skips filers that are already in the worker or in the queue.
-func (n *NetAppSD) updateFilerQueue(filerInWorkers map[string]struct{}) {
+func (n *NetAppSD) updateFilerQueue(ctx context.Context, filerInWorkers map[string]struct{}) {
 	filerInQueue := make(map[string]struct{})
 	for _, filer := range n.filerQueue {
 		filerInQueue[filer.Name] = struct{}{}
@@ -327,40 +773,56 @@ func (n *NetAppSD) updateFilerQueue(filerInWorkers map[string]struct{}) {
 		if _, ok := filerInQueue[filerName]; ok {
 			continue
 		}
-		// Do not add filer to the queue if it is not probed in the last
-		// 5 minutes. This is to avoid adding filers that are not
-		// reachable. Filers are fetched from Netbox and probed every 5
-		// minutes. And queue is updated every 30 seconds.
+		if reason, ok := n.overrides.Excluded[filerName]; ok {
+			slog.Debug("skip excluded filer", "filer", filerName, "reason", reason)
+			continue
+		}
+		// Do not add filer to the queue if it was not probed in the last
+		// discovery. This is to avoid adding filers that are not
+		// reachable.
 		lastProbeTime := n.lastProbeFilerTs.LoadTime(filerName)
-		if time.Since(lastProbeTime) > 5*time.Minute {
+		if time.Since(lastProbeTime) > n.probeStaleness() {
 			slog.Info("skip filer", "filer", filerName, "lastProbeTime", lastProbeTime)
 			continue
 		}
 		n.filerQueue = append(n.filerQueue, n.filerList[filerName])
 		slog.Info("enqueue filer", "filer", filerName)
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerEnqueued", "Enqueued filer %s, waiting for a free worker", filerName)
 	}
 }
 
-func (n *NetAppSD) scaleUpWorkers(ctx context.Context, count int) error {
-	if count <= 0 {
-		return nil
-	}
-
+// scaleUpWorkers scales the worker deployment up to the target replicas, but
+// at least to the minimum replicas. It does not scale down.
+func (n *NetAppSD) scaleUpWorkers(ctx context.Context, target int) error {
 	workerDeployment, err := n.kubeClientset.AppsV1().Deployments(n.Namespace).Get(ctx, n.WorkerName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
+	n.setDeploymentRef(workerDeployment)
 
 	currentReplicas := *workerDeployment.Spec.Replicas
-	targetReplicas := int32(int(currentReplicas) + count)
+	targetReplicas := max(int32(target), n.MinReplicas)
+	if targetReplicas <= currentReplicas {
+		return nil
+	}
+	targetReplicas = n.limitReplicas(currentReplicas, targetReplicas)
+	if targetReplicas <= currentReplicas {
+		return nil
+	}
+	if n.DryRun {
+		n.planAction("scale deployment", n.WorkerName, "replicas %d -> %d for %d queued filers", currentReplicas, targetReplicas, len(n.filerQueue))
+		return nil
+	}
 	workerDeployment.Spec.Replicas = &targetReplicas
 
 	if _, err = n.kubeClientset.AppsV1().Deployments(n.Namespace).Update(ctx, workerDeployment, metav1.UpdateOptions{}); err != nil {
 		return err
 	}
 
-	workerReplicas.WithLabelValues().Set(float64(targetReplicas))
+	n.lastScaleUp = time.Now()
+	workerReplicas.WithLabelValues(n.Pool).Set(float64(targetReplicas))
 	slog.Info("scale up worker deployment", "current", currentReplicas, "target", targetReplicas)
+	n.recorder.Eventf(workerDeployment, v1.EventTypeNormal, "ScaledUp", "Scaled up workers from %d to %d for %d queued filers", currentReplicas, targetReplicas, len(n.filerQueue))
 	return nil
 }
 
@@ -373,71 +835,110 @@ func (n *NetAppSD) scaleDownWorkers(ctx context.Context, count int) error {
 	if err != nil {
 		return err
 	}
+	n.setDeploymentRef(workerDeployment)
 
 	currentReplicas := *workerDeployment.Spec.Replicas
-	targetReplicas := int32(int(currentReplicas) - count)
+	targetReplicas := n.limitReplicas(currentReplicas, int32(int(currentReplicas)-count))
+	if targetReplicas >= currentReplicas {
+		return nil
+	}
+	if n.DryRun {
+		n.planAction("scale deployment", n.WorkerName, "replicas %d -> %d to delete %d retired workers", currentReplicas, targetReplicas, count)
+		return nil
+	}
 	workerDeployment.Spec.Replicas = &targetReplicas
 
 	if _, err = n.kubeClientset.AppsV1().Deployments(n.Namespace).Update(ctx, workerDeployment, metav1.UpdateOptions{}); err != nil {
 		return err
 	}
 
-	workerReplicas.WithLabelValues().Set(float64(targetReplicas))
+	n.lastScaleDown = time.Now()
+	workerReplicas.WithLabelValues(n.Pool).Set(float64(targetReplicas))
 	slog.Info("scale down worker replicas", "current", currentReplicas, "target", targetReplicas)
+	n.recorder.Eventf(workerDeployment, v1.EventTypeNormal, "ScaledDown", "Scaled down workers from %d to %d to delete %d retired workers", currentReplicas, targetReplicas, count)
 	return nil
 }
 
 // prepareDeletingWorkers marks the pod by setting the deletion cost to -999 and
 // returns the number of pods marked. It skips the pods that are being deleted.
-// The pods that are associated with filers that are not probed in the last 48
-// hours are marked for deletion.
+// The pods that are associated with filers that are removed from netbox, or
+// not probed in the last 48 hours are marked for deletion.
 func (n *NetAppSD) prepareDeletingWorkers(ctx context.Context) (int, error) {
-	workerPods, err := n.kubeClientset.CoreV1().Pods(n.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: n.WorkerLabel,
-	})
+	workerPods, err := n.listWorkerPods(ctx)
 	if err != nil {
 		return 0, err
 	}
 	cnt := 0
-	for _, pod := range workerPods.Items {
+	for _, pod := range workerPods {
 		// skip worker being deleted
 		if pod.DeletionTimestamp != nil {
 			slog.Info("skip terminating pod", "pod", pod.Name)
 			continue
 		}
-		if filerName, hasFilerLabel := pod.Labels["filer"]; hasFilerLabel {
-			retire := false
-			if _, found := n.inactiveFilers[filerName]; found {
-				slog.Info("retire inactive worker", "filer", filerName, "pod", pod.Name)
-				retire = true
-			} else {
-				lastProbeTime := n.lastProbeFilerTs.LoadTime(filerName)
-				if n.lastProbeError == nil && time.Since(lastProbeTime) > 48*time.Hour {
-					slog.Info("retire old worker", "filer", filerName, "pod", pod.Name, "lastProbeTime", lastProbeTime)
-					retire = true
-				}
-			}
-			if retire {
-				if err := n.updatePodDeletionCost(ctx, pod); err != nil {
-					return 0, err
-				}
-				cnt++
-			}
-		} else {
+		retireReason := n.workerRetireReason(pod)
+		if filerName, hasFilerLabel := pod.Labels["filer"]; !hasFilerLabel {
 			slog.Warn("pod does not have filer label", "pod", pod.Name)
+		} else if retireReason != "" {
+			slog.Info("retire worker", "filer", filerName, "pod", pod.Name, "reason", retireReason)
+		}
+		if retireReason != "" && n.DryRun {
+			n.planAction("retire worker", pod.Name, "%s", retireReason)
+			cnt++
+		} else if retireReason != "" {
 			if err := n.updatePodDeletionCost(ctx, pod); err != nil {
 				return 0, err
 			}
+			n.recorder.Eventf(&pod, v1.EventTypeNormal, "WorkerRetired", "Marked worker for deletion: %s", retireReason)
 			cnt++
 		}
 	}
 	return cnt, nil
 }
 
+// deleteRetiredWorkers deletes the worker pods whose filer is retired, e.g.
+// removed from netbox, so that they stop scraping it. The worker deployment
+// replaces them.
+func (n *NetAppSD) deleteRetiredWorkers(ctx context.Context) error {
+	workerPods, err := n.listWorkerPods(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pod := range workerPods {
+		filerName, found := pod.Labels["filer"]
+		if !found || pod.DeletionTimestamp != nil {
+			continue
+		}
+		retireReason := n.retireReason(filerName)
+		if retireReason == "" {
+			continue
+		}
+		if n.DryRun {
+			n.planAction("delete worker", pod.Name, "%s", retireReason)
+			continue
+		}
+		slog.Info("delete retired worker", "filer", filerName, "pod", pod.Name, "reason", retireReason)
+		err := n.kubeClientset.CoreV1().Pods(n.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		n.recorder.Eventf(&pod, v1.EventTypeNormal, "WorkerRetired", "Deleted worker: %s", retireReason)
+	}
+	return nil
+}
+
 func (n *NetAppSD) updatePodDeletionCost(ctx context.Context, pod v1.Pod) error {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
 	pod.Annotations["controller.kubernetes.io/pod-deletion-cost"] = "-999"
-	if _, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, &pod, metav1.UpdateOptions{}); err != nil {
+	if n.DryRun {
+		n.planAction("set deletion cost", pod.Name, "pod-deletion-cost=-999")
+		return nil
+	}
+	updated, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Update(ctx, &pod, metav1.UpdateOptions{})
+	if err != nil {
 		return err
 	}
+	n.assumePod(updated)
 	return nil
 }
@@ -0,0 +1,343 @@
+package netappsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+const (
+	testNamespace = "netapp-exporters"
+	testWorker    = "netappsd-worker"
+)
+
+// stubSource and stubOntap are not queried by the tests, which set the
+// discovered filers directly.
+type stubSource struct{}
+
+func (stubSource) GetFilers(context.Context, string, string) ([]netbox.Filer, error) {
+	return nil, nil
+}
+
+func (stubSource) GetFiler(context.Context, string, string, string) (*netbox.Filer, error) {
+	return nil, nil
+}
+
+type stubOntap struct{}
+
+func (stubOntap) Probe(context.Context, netbox.Filer) error { return nil }
+
+func (stubOntap) GetCluster(context.Context, netbox.Filer) (*netapp.Cluster, error) {
+	return &netapp.Cluster{}, nil
+}
+
+// newTestMaster returns a master with a fake client, which has the worker
+// deployment with the replicas and the worker pods. The filer label of a pod
+// is set if the filer is not empty.
+func newTestMaster(t *testing.T, replicas int32, podFilers map[string]string) (*NetAppSD, *fake.Clientset) {
+	t.Helper()
+	labels := map[string]string{"app": testWorker}
+	objects := []runtime.Object{&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: testWorker, Namespace: testNamespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		},
+	}}
+	for podName, filerName := range podFilers {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: testNamespace, Labels: map[string]string{"app": testWorker}},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		}
+		if filerName != "" {
+			pod.Labels["filer"] = filerName
+		}
+		objects = append(objects, pod)
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+
+	n, err := New(context.Background(), &NetAppSD{
+		Namespace:   testNamespace,
+		WorkerName:  testWorker,
+		WorkerLabel: "app=" + testWorker,
+	}, WithKubeClient(clientset), WithFilerSource(stubSource{}), WithOntap(stubOntap{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.broadcaster.Shutdown)
+	return n, clientset
+}
+
+// addFilers adds discovered filers, which were probed at the time.
+func addFilers(n *NetAppSD, probed time.Time, names ...string) {
+	for _, name := range names {
+		n.filerList[name] = Filer{Name: name, Host: name + ".example.com", Status: "active"}
+		n.lastProbeFilerTs.Store(name, probed.Unix())
+	}
+}
+
+func podFiler(t *testing.T, clientset *fake.Clientset, podName string) string {
+	t.Helper()
+	pod, err := clientset.CoreV1().Pods(testNamespace).Get(context.Background(), podName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pod.Labels["filer"]
+}
+
+func workerReplicasOf(t *testing.T, clientset *fake.Clientset) int32 {
+	t.Helper()
+	d, err := clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), testWorker, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *d.Spec.Replicas
+}
+
+func queuedFilers(n *NetAppSD) []string {
+	names := make([]string, 0, len(n.filerQueue))
+	for _, f := range n.filerQueue {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestNextFiler(t *testing.T) {
+	ctx := context.Background()
+	n, clientset := newTestMaster(t, 2, map[string]string{"worker-a": "", "worker-b": ""})
+	addFilers(n, time.Now(), "filer-1")
+	n.filerQueue = []Filer{n.filerList["filer-1"]}
+
+	filer, err := n.NextFiler(ctx, "worker-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filer.Name != "filer-1" {
+		t.Fatalf("got filer %s, want filer-1", filer.Name)
+	}
+	if got := podFiler(t, clientset, "worker-a"); got != "filer-1" {
+		t.Fatalf("pod is labelled with filer %q, want filer-1", got)
+	}
+	if len(n.filerQueue) != 0 {
+		t.Fatalf("queue is %v, want it empty", queuedFilers(n))
+	}
+
+	if _, err := n.NextFiler(ctx, "worker-b"); err == nil {
+		t.Fatal("got a filer from the empty queue")
+	}
+	if got := podFiler(t, clientset, "worker-b"); got != "" {
+		t.Fatalf("pod is labelled with filer %q, want none", got)
+	}
+}
+
+func TestNextFilerPinned(t *testing.T) {
+	ctx := context.Background()
+	n, _ := newTestMaster(t, 2, map[string]string{"worker-a": "", "worker-b": ""})
+	addFilers(n, time.Now(), "filer-1", "filer-2")
+	n.filerQueue = []Filer{n.filerList["filer-1"], n.filerList["filer-2"]}
+	n.overrides.Pinned["filer-1"] = "worker-b"
+
+	filer, err := n.NextFiler(ctx, "worker-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filer.Name != "filer-2" {
+		t.Fatalf("got filer %s, want filer-2, since filer-1 is pinned to worker-b", filer.Name)
+	}
+	if filer, err = n.NextFiler(ctx, "worker-b"); err != nil {
+		t.Fatal(err)
+	}
+	if filer.Name != "filer-1" {
+		t.Fatalf("got filer %s, want the pinned filer-1", filer.Name)
+	}
+}
+
+func TestUpdateFilerQueue(t *testing.T) {
+	n, _ := newTestMaster(t, 0, nil)
+	addFilers(n, time.Now(), "filer-1", "filer-2", "filer-3", "filer-4")
+	addFilers(n, time.Now().Add(-time.Hour), "filer-stale")
+	n.overrides.Excluded["filer-3"] = "maintenance"
+	n.filerQueue = []Filer{n.filerList["filer-4"]}
+
+	n.updateFilerQueue(context.Background(), map[string]struct{}{"filer-2": {}})
+
+	// filer-2 has a worker, filer-3 is excluded, filer-4 is queued already
+	// and filer-stale was not probed recently
+	got := queuedFilers(n)
+	if len(got) != 2 || got[0] != "filer-4" || got[1] != "filer-1" {
+		t.Fatalf("queue is %v, want [filer-4 filer-1]", got)
+	}
+}
+
+func TestScaleUpForQueuedFilers(t *testing.T) {
+	n, clientset := newTestMaster(t, 2, map[string]string{"worker-a": "filer-1", "worker-b": ""})
+	addFilers(n, time.Now(), "filer-1", "filer-2", "filer-3", "filer-4")
+
+	if err := n.updateWorkerReplica(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(n.filerQueue); got != 3 {
+		t.Fatalf("queue is %v, want 3 filers", queuedFilers(n))
+	}
+	// one worker is assigned and three filers are queued; the free worker
+	// takes one of them
+	if got := workerReplicasOf(t, clientset); got != 4 {
+		t.Fatalf("worker replicas are %d, want 4", got)
+	}
+
+	// a repeated update, e.g. on a pod event, does not scale up again
+	if err := n.updateWorkerReplica(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := workerReplicasOf(t, clientset); got != 4 {
+		t.Fatalf("worker replicas are %d after a repeated update, want 4", got)
+	}
+}
+
+func TestScaleUpToMinReplicas(t *testing.T) {
+	n, clientset := newTestMaster(t, 1, map[string]string{"worker-a": ""})
+	n.MinReplicas = 3
+
+	if err := n.updateWorkerReplica(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := workerReplicasOf(t, clientset); got != 3 {
+		t.Fatalf("worker replicas are %d, want the minimum 3", got)
+	}
+}
+
+func TestRetireInactiveAndStaleFilers(t *testing.T) {
+	ctx := context.Background()
+	n, clientset := newTestMaster(t, 3, map[string]string{
+		"worker-a": "filer-active",
+		"worker-b": "filer-inactive",
+		"worker-c": "filer-stale",
+	})
+	addFilers(n, time.Now(), "filer-active", "filer-inactive")
+	addFilers(n, time.Now().Add(-72*time.Hour), "filer-stale")
+	n.inactiveFilers["filer-inactive"] = struct{}{}
+	n.discovered.Store(true)
+
+	if err := n.updateWorkerReplica(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for podName, wantRetired := range map[string]bool{"worker-a": false, "worker-b": true, "worker-c": true} {
+		pod, err := clientset.CoreV1().Pods(testNamespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, retired := pod.Annotations["controller.kubernetes.io/pod-deletion-cost"]
+		if retired != wantRetired {
+			t.Errorf("pod %s has deletion cost %t, want %t", podName, retired, wantRetired)
+		}
+	}
+	if got := workerReplicasOf(t, clientset); got != 1 {
+		t.Fatalf("worker replicas are %d, want 1", got)
+	}
+}
+
+func TestUpdateFilerQueueProbeStaleness(t *testing.T) {
+	n, _ := newTestMaster(t, 0, nil)
+	n.DiscoveryInterval = 15 * time.Minute
+	addFilers(n, time.Now().Add(-10*time.Minute), "filer-1")
+	addFilers(n, time.Now().Add(-20*time.Minute), "filer-stale")
+
+	n.updateFilerQueue(context.Background(), nil)
+
+	// filer-1 was probed in the last discovery
+	got := queuedFilers(n)
+	if len(got) != 1 || got[0] != "filer-1" {
+		t.Fatalf("queue is %v, want [filer-1]", got)
+	}
+}
+
+func TestNoRetirementBeforeDiscovery(t *testing.T) {
+	ctx := context.Background()
+	n, clientset := newTestMaster(t, 3, map[string]string{
+		"worker-a": "filer-1",
+		"worker-b": "filer-2",
+		"worker-c": "filer-3",
+	})
+
+	// the first worker update after a start runs before the discovery
+	if err := n.updateWorkerReplica(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// after the discovery, the filers that were not probed yet are not stale
+	n.discovered.Store(true)
+	if err := n.updateWorkerReplica(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pods, err := clientset.CoreV1().Pods(testNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pod := range pods.Items {
+		if cost, found := pod.Annotations["controller.kubernetes.io/pod-deletion-cost"]; found {
+			t.Errorf("pod %s has deletion cost %s, want none", pod.Name, cost)
+		}
+	}
+	if got := workerReplicasOf(t, clientset); got != 3 {
+		t.Fatalf("worker replicas are %d, want 3", got)
+	}
+}
+
+func TestNoFilerWorkloadDeletionBeforeDiscovery(t *testing.T) {
+	ctx := context.Background()
+	replicas := int32(0)
+	labels := map[string]string{"app": testWorker}
+	template := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: testWorker, Namespace: testNamespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		},
+	}
+	workload := filerWorkloadName(testWorker, "filer-1")
+	clientset := fake.NewSimpleClientset(template,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name:      workload,
+			Namespace: testNamespace,
+			Labels:    map[string]string{workerOfLabel: testWorker, "filer": "filer-1"},
+		}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: configSecretName(workload), Namespace: testNamespace}},
+	)
+	n, err := New(ctx, &NetAppSD{
+		Namespace:   testNamespace,
+		WorkerName:  testWorker,
+		WorkerLabel: "app=" + testWorker,
+		WorkerMode:  WorkerModePerFiler,
+	}, WithKubeClient(clientset), WithFilerSource(stubSource{}), WithOntap(stubOntap{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.broadcaster.Shutdown)
+	// e.g. a filer discovered from a netbox webhook before the discovery
+	n.filerList["filer-2"] = Filer{Name: "filer-2", Status: "active"}
+
+	if err := n.updateFilerWorkloads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// after the discovery, filer-1 was not probed yet, which is not stale
+	n.discovered.Store(true)
+	if err := n.updateFilerWorkloads(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientset.AppsV1().Deployments(testNamespace).Get(ctx, workload, metav1.GetOptions{}); err != nil {
+		t.Fatalf("deployment of filer-1: %s", err)
+	}
+	if _, err := clientset.CoreV1().Secrets(testNamespace).Get(ctx, configSecretName(workload), metav1.GetOptions{}); err != nil {
+		t.Fatalf("config secret of filer-1: %s", err)
+	}
+}
@@ -0,0 +1,56 @@
+package netappsd
+
+import (
+	"context"
+	"log/slog"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+// newEventRecorder returns a recorder that writes Kubernetes Events to the
+// given namespace, and its broadcaster, which must be shut down when the
+// master stops.
+func newEventRecorder(clientset kubernetes.Interface, namespace string) (record.EventRecorder, record.EventBroadcaster) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(namespace),
+	})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "netappsd-master"}), broadcaster
+}
+
+// recordDeploymentEvent records an event on the worker deployment. The
+// reference to the deployment is fetched once, and updated whenever the
+// master gets the deployment anyway. Failing to get the deployment is logged
+// and otherwise ignored.
+func (n *NetAppSD) recordDeploymentEvent(ctx context.Context, eventtype, reason, messageFmt string, args ...interface{}) {
+	ref := n.deploymentRef.Load()
+	if ref == nil {
+		deployment, err := n.kubeClientset.AppsV1().Deployments(n.Namespace).Get(ctx, n.WorkerName, metav1.GetOptions{})
+		if err != nil {
+			slog.Warn("failed to record event on worker deployment", "reason", reason, "error", err)
+			return
+		}
+		if ref = n.setDeploymentRef(deployment); ref == nil {
+			return
+		}
+	}
+	n.recorder.Eventf(ref, eventtype, reason, messageFmt, args...)
+}
+
+// setDeploymentRef caches the reference to the worker deployment for events.
+func (n *NetAppSD) setDeploymentRef(deployment *appsv1.Deployment) *v1.ObjectReference {
+	ref, err := reference.GetReference(scheme.Scheme, deployment)
+	if err != nil {
+		slog.Warn("failed to get reference of worker deployment", "error", err)
+		return nil
+	}
+	n.deploymentRef.Store(ref)
+	return ref
+}
@@ -0,0 +1,78 @@
+package netappsd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+	"github.com/sapcc/netappsd/internal/pkg/utils"
+)
+
+// inventoryCache keeps the last filer inventory that was successfully fetched
+// from netbox. It is used to keep probing the filers while netbox is
+// unreachable. If path is set, the inventory is also persisted to disk, so
+// that it survives restarts of the master.
+type inventoryCache struct {
+	path string
+	pool string
+
+	mu      sync.Mutex
+	Filers  []netbox.Filer `json:"filers"`
+	Updated time.Time      `json:"updated"`
+}
+
+func newInventoryCache(path, pool string) *inventoryCache {
+	return &inventoryCache{path: path, pool: pool}
+}
+
+// Load reads the inventory from disk. A missing file is not an error.
+func (c *inventoryCache) Load() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.Unmarshal(b, c); err != nil {
+		return err
+	}
+	inventoryLastUpdate.WithLabelValues(c.pool).Set(float64(c.Updated.Unix()))
+	return nil
+}
+
+// Store replaces the inventory and writes it to disk atomically, so that a
+// crash never leaves a partial inventory behind.
+func (c *inventoryCache) Store(filers []netbox.Filer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Filers = filers
+	c.Updated = time.Now()
+	inventoryLastUpdate.WithLabelValues(c.pool).Set(float64(c.Updated.Unix()))
+
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(c.path, b, 0o600)
+}
+
+// Get returns the cached filers and the time they were fetched from netbox.
+// The time is zero if no inventory has been cached yet.
+func (c *inventoryCache) Get() ([]netbox.Filer, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Filers, c.Updated
+}
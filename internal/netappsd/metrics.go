@@ -4,31 +4,104 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// The metrics are labelled with the pool of the master, since the controller
+// runs the masters of several pools in one process.
+
 var (
 	discoveredFiler = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "netappsd_discovered_filer",
 		Help: "Filer discovered from netbox.",
-	}, []string{"filer", "host", "ip"})
+	}, []string{"pool", "filer", "host", "ip"})
 
 	enqueuedFiler = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "netappsd_enqueued_filer",
 		Help: "Filer enqueued to work on.",
-	}, []string{"filer", "host", "ip"})
+	}, []string{"pool", "filer", "host", "ip"})
+
+	filerUnassignedSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netappsd_filer_unassigned_seconds",
+		Help: "Time the queued filer has waited for a worker.",
+	}, []string{"pool", "filer"})
 
 	probeFilerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "netappsd_probe_filer_errors",
 		Help: "Number of errors encountered while probing filer.",
-	}, []string{"filer", "host", "ip"})
+	}, []string{"pool", "filer", "host", "ip"})
 
 	workerReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "netappsd_worker_replicas",
 		Help: "Number of worker replicas.",
-	}, []string{})
+	}, []string{"pool"})
+
+	desiredWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netappsd_desired_workers",
+		Help: "Number of workers needed for the assigned and queued filers.",
+	}, []string{"pool"})
+
+	scaleLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netappsd_scale_limited_total",
+		Help: "Number of worker scalings limited by a replica limit, step limit or cooldown.",
+	}, []string{"pool", "limit"})
+
+	rebalanceMoves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netappsd_rebalance_moves_total",
+		Help: "Number of filers moved by the rebalancer, by result.",
+	}, []string{"pool", "result"})
+
+	discoveryTriggers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netappsd_discovery_triggers_total",
+		Help: "Number of filer discoveries triggered outside of the regular interval.",
+	}, []string{"pool", "source"})
+
+	inventoryChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netappsd_inventory_changes_total",
+		Help: "Number of filers added, removed or changed in netbox between discoveries.",
+	}, []string{"pool", "change"})
+
+	netboxDegraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netappsd_netbox_degraded",
+		Help: "Netbox is unreachable and the last known inventory is used.",
+	}, []string{"pool"})
+
+	inventoryLastUpdate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netappsd_inventory_last_update_timestamp_seconds",
+		Help: "Time the filer inventory was last fetched from netbox.",
+	}, []string{"pool"})
 )
 
 func init() {
 	prometheus.MustRegister(discoveredFiler)
 	prometheus.MustRegister(enqueuedFiler)
+	prometheus.MustRegister(filerUnassignedSeconds)
 	prometheus.MustRegister(probeFilerErrors)
 	prometheus.MustRegister(workerReplicas)
+	prometheus.MustRegister(desiredWorkers)
+	prometheus.MustRegister(scaleLimited)
+	prometheus.MustRegister(rebalanceMoves)
+	prometheus.MustRegister(discoveryTriggers)
+	prometheus.MustRegister(inventoryChanges)
+	prometheus.MustRegister(netboxDegraded)
+	prometheus.MustRegister(inventoryLastUpdate)
+}
+
+// deletePoolMetrics deletes the metrics of the pool, e.g. when its master
+// stops.
+func deletePoolMetrics(pool string) {
+	labels := prometheus.Labels{"pool": pool}
+	for _, vec := range []*prometheus.MetricVec{
+		discoveredFiler.MetricVec,
+		enqueuedFiler.MetricVec,
+		filerUnassignedSeconds.MetricVec,
+		probeFilerErrors.MetricVec,
+		workerReplicas.MetricVec,
+		desiredWorkers.MetricVec,
+		scaleLimited.MetricVec,
+		rebalanceMoves.MetricVec,
+		discoveryTriggers.MetricVec,
+		inventoryChanges.MetricVec,
+		netboxDegraded.MetricVec,
+		inventoryLastUpdate.MetricVec,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
 }
@@ -0,0 +1,75 @@
+package netappsd
+
+import (
+	"context"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// FilerSource returns the filers of a region with a tag. It is implemented
+// by the netbox client.
+type FilerSource interface {
+	GetFilers(ctx context.Context, region, tag string) ([]netbox.Filer, error)
+	// GetFiler returns the filer with the name, or nil if there is none.
+	GetFiler(ctx context.Context, region, tag, name string) (*netbox.Filer, error)
+}
+
+// Ontap queries the ONTAP API of a filer.
+type Ontap interface {
+	// Probe checks that the filer is reachable with the NetApp credentials.
+	Probe(ctx context.Context, filer netbox.Filer) error
+	GetCluster(ctx context.Context, filer netbox.Filer) (*netapp.Cluster, error)
+}
+
+// ontapClient queries the filer at its IP address, or its host name if it
+// has no IP address.
+type ontapClient struct {
+	username string
+	password string
+}
+
+func (c ontapClient) client(filer netbox.Filer) *netapp.FilerClient {
+	address := filer.Ip
+	if address == "" {
+		address = filer.Host
+	}
+	return netapp.NewFilerClient(address, c.username, c.password)
+}
+
+func (c ontapClient) Probe(ctx context.Context, filer netbox.Filer) error {
+	return c.client(filer).Probe(ctx)
+}
+
+func (c ontapClient) GetCluster(ctx context.Context, filer netbox.Filer) (*netapp.Cluster, error) {
+	return c.client(filer).GetCluster(ctx)
+}
+
+// Option sets a client of the master, instead of the one Run creates.
+type Option func(*NetAppSD)
+
+// WithKubeClient sets the Kubernetes client, e.g. a shared or a fake one.
+// By default, Run creates an in-cluster client.
+func WithKubeClient(clientset kubernetes.Interface) Option {
+	return func(n *NetAppSD) {
+		n.kubeClientset = clientset
+	}
+}
+
+// WithFilerSource sets the source of the filers. By default, Run creates a
+// netbox client with NetboxHost, NetboxToken and NetboxOptions.
+func WithFilerSource(source FilerSource) Option {
+	return func(n *NetAppSD) {
+		n.filerSource = source
+	}
+}
+
+// WithOntap sets the client of the ONTAP API, e.g. a stub. By default, Run
+// uses the NetApp credentials.
+func WithOntap(ontap Ontap) Option {
+	return func(n *NetAppSD) {
+		n.ontap = ontap
+	}
+}
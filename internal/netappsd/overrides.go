@@ -0,0 +1,276 @@
+package netappsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const overridesConfigMapKey = "overrides.json"
+
+// Overrides are manual changes to the filer assignment, e.g. for maintenance.
+// They are persisted in a ConfigMap, so that they survive restarts of the
+// master.
+type Overrides struct {
+	// Pinned maps filers to the only pod they are assigned to.
+	Pinned map[string]string `json:"pinned"`
+	// Excluded maps filers that are not scraped to the reason.
+	Excluded map[string]string `json:"excluded"`
+	// Drained maps worker pods that get no filer and are deleted to the
+	// reason.
+	Drained map[string]string `json:"drained"`
+}
+
+func newOverrides() Overrides {
+	return Overrides{
+		Pinned:   make(map[string]string),
+		Excluded: make(map[string]string),
+		Drained:  make(map[string]string),
+	}
+}
+
+// loadOverrides reads the overrides from the ConfigMap. A missing ConfigMap
+// means no overrides.
+func (n *NetAppSD) loadOverrides(ctx context.Context) error {
+	n.overrides = newOverrides()
+	cm, err := n.kubeClientset.CoreV1().ConfigMaps(n.Namespace).Get(ctx, n.OverridesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded Overrides
+	if data, found := cm.Data[overridesConfigMapKey]; found {
+		if err := json.Unmarshal([]byte(data), &loaded); err != nil {
+			return fmt.Errorf("invalid overrides in configmap %s: %w", n.OverridesConfigMap, err)
+		}
+	}
+	for k, v := range loaded.Pinned {
+		n.overrides.Pinned[k] = v
+	}
+	for k, v := range loaded.Excluded {
+		n.overrides.Excluded[k] = v
+	}
+	for k, v := range loaded.Drained {
+		n.overrides.Drained[k] = v
+	}
+	slog.Info("overrides loaded", "pinned", len(n.overrides.Pinned), "excluded", len(n.overrides.Excluded), "drained", len(n.overrides.Drained))
+	return nil
+}
+
+// saveOverrides writes the overrides to the ConfigMap. It must be called with
+// n.mu held.
+func (n *NetAppSD) saveOverrides(ctx context.Context) error {
+	// apply the changed overrides to the workers right away
+	n.reconcileWorkersSoon()
+	b, err := json.Marshal(n.overrides)
+	if err != nil {
+		return err
+	}
+	if n.DryRun {
+		n.planAction("save overrides", n.OverridesConfigMap, "%s", b)
+		return nil
+	}
+	configMaps := n.kubeClientset.CoreV1().ConfigMaps(n.Namespace)
+	cm, err := configMaps.Get(ctx, n.OverridesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      n.OverridesConfigMap,
+				Namespace: n.Namespace,
+			},
+			Data: map[string]string{overridesConfigMapKey: string(b)},
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[overridesConfigMapKey] = string(b)
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// Overrides returns a copy of the current overrides.
+func (n *NetAppSD) Overrides() Overrides {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	o := newOverrides()
+	for k, v := range n.overrides.Pinned {
+		o.Pinned[k] = v
+	}
+	for k, v := range n.overrides.Excluded {
+		o.Excluded[k] = v
+	}
+	for k, v := range n.overrides.Drained {
+		o.Drained[k] = v
+	}
+	return o
+}
+
+// PinFiler assigns the filer only to the given pod, which must be a worker
+// without a filer, e.g. a new worker waiting for its filer. If the filer is
+// assigned to another worker, that worker is drained.
+func (n *NetAppSD) PinFiler(ctx context.Context, filerName, podName string) error {
+	if n.WorkerMode == WorkerModePerFiler {
+		return errPerFilerMode
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	pod, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %s", err)
+	}
+	if current, found := pod.Labels["filer"]; found && current != filerName {
+		return fmt.Errorf("pod %s already works on filer %s", podName, current)
+	}
+	if _, found := n.overrides.Drained[podName]; found {
+		return fmt.Errorf("pod %s is drained", podName)
+	}
+
+	n.overrides.Pinned[filerName] = podName
+	if err := n.saveOverrides(ctx); err != nil {
+		return err
+	}
+	slog.Info("pin filer", "filer", filerName, "pod", podName)
+	n.recorder.Eventf(pod, v1.EventTypeNormal, "FilerPinned", "Pinned filer %s to worker", filerName)
+
+	// move the filer away from its current worker
+	pods, err := n.listWorkerPods(ctx, "filer="+filerName)
+	if err != nil {
+		return err
+	}
+	for _, p := range pods {
+		if p.Name != podName {
+			if err := n.drainPod(ctx, p.Name, "filer "+filerName+" pinned to "+podName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *NetAppSD) UnpinFiler(ctx context.Context, filerName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.overrides.Pinned, filerName)
+	slog.Info("unpin filer", "filer", filerName)
+	return n.saveOverrides(ctx)
+}
+
+// ExcludeFiler stops scraping the filer, e.g. during maintenance. The filer is
+// removed from the queue and its worker is retired.
+func (n *NetAppSD) ExcludeFiler(ctx context.Context, filerName, reason string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reason == "" {
+		reason = "excluded at " + time.Now().UTC().Format(time.RFC3339)
+	}
+	n.overrides.Excluded[filerName] = reason
+	n.removeFromQueue(filerName)
+	slog.Info("exclude filer", "filer", filerName, "reason", reason)
+	n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerExcluded", "Excluded filer %s: %s", filerName, reason)
+	return n.saveOverrides(ctx)
+}
+
+func (n *NetAppSD) IncludeFiler(ctx context.Context, filerName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.overrides.Excluded, filerName)
+	slog.Info("include filer", "filer", filerName)
+	n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerIncluded", "Included filer %s again", filerName)
+	return n.saveOverrides(ctx)
+}
+
+// DrainWorker removes the filer from the worker, so that the filer is queued
+// for another worker, and deletes the worker pod, see drainPod.
+func (n *NetAppSD) DrainWorker(ctx context.Context, podName, reason string) error {
+	if n.WorkerMode == WorkerModePerFiler {
+		return errPerFilerMode
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reason == "" {
+		reason = "drained at " + time.Now().UTC().Format(time.RFC3339)
+	}
+	return n.drainPod(ctx, podName, reason)
+}
+
+// drainPod removes the filer label from the worker pod and deletes the pod,
+// since the worker keeps scraping its filer until it stops. The worker
+// deployment replaces the pod. It must be called with n.mu held.
+func (n *NetAppSD) drainPod(ctx context.Context, podName, reason string) error {
+	n.overrides.Drained[podName] = reason
+	if err := n.saveOverrides(ctx); err != nil {
+		return err
+	}
+	slog.Info("drain worker", "pod", podName, "reason", reason)
+	if err := n.clearFilerLabelForPod(ctx, podName); err != nil {
+		return err
+	}
+	pod, err := n.kubeClientset.CoreV1().Pods(n.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %s", err)
+	}
+	if n.DryRun {
+		n.planAction("delete worker", podName, "drained: %s", reason)
+		return nil
+	}
+	err = n.kubeClientset.CoreV1().Pods(n.Namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod: %s", err)
+	}
+	n.recorder.Eventf(pod, v1.EventTypeNormal, "WorkerDrained", "Drained and deleted worker: %s", reason)
+	return nil
+}
+
+// UndrainWorker lets the worker request a filer again. A worker that has
+// already been retired is not restored.
+func (n *NetAppSD) UndrainWorker(ctx context.Context, podName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.overrides.Drained, podName)
+	slog.Info("undrain worker", "pod", podName)
+	return n.saveOverrides(ctx)
+}
+
+// pruneOverrides removes drained pods and pins to pods that do not exist
+// anymore. It must be called with n.mu held.
+func (n *NetAppSD) pruneOverrides(ctx context.Context, pods []v1.Pod) {
+	existing := make(map[string]struct{}, len(pods))
+	for _, pod := range pods {
+		existing[pod.Name] = struct{}{}
+	}
+	changed := false
+	for podName := range n.overrides.Drained {
+		if _, found := existing[podName]; !found {
+			slog.Info("drained worker is gone", "pod", podName)
+			delete(n.overrides.Drained, podName)
+			changed = true
+		}
+	}
+	for filerName, podName := range n.overrides.Pinned {
+		if _, found := existing[podName]; !found {
+			slog.Info("unpin filer from deleted worker", "filer", filerName, "pod", podName)
+			delete(n.overrides.Pinned, filerName)
+			changed = true
+		}
+	}
+	if changed {
+		if err := n.saveOverrides(ctx); err != nil {
+			slog.Warn("failed to save overrides", "error", err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package netappsd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+)
+
+// Worker modes of the master.
+const (
+	// WorkerModeShared scales one worker deployment to the number of filers
+	// and assigns the filers to its pods via /next/filer.
+	WorkerModeShared = "shared"
+	// WorkerModePerFiler creates one worker deployment per filer from the
+	// worker deployment, which is only used as template.
+	WorkerModePerFiler = "per-filer"
+)
+
+const (
+	// workerOfLabel is set on the deployments created per filer, with the
+	// name of the template worker deployment.
+	workerOfLabel = "netappsd/worker-of"
+	// filerEnv is the environment variable the filer is passed to the worker
+	// in.
+	filerEnv = "FILER"
+	// templateGenerationAnnotation is the generation of the template worker
+	// deployment a deployment was created or updated from.
+	templateGenerationAnnotation = "netappsd/template-generation"
+)
+
+// errPerFilerMode is returned by the operations on pods of the shared worker
+// deployment.
+var errPerFilerMode = errors.New("not supported in per-filer worker mode, the filer of a worker is set by the master")
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// filerWorkloadName returns the name of the deployment of the filer, which
+// must be a valid DNS label. Names longer than 63 characters are truncated
+// and suffixed with a hash of the filer name, so that they do not collide.
+func filerWorkloadName(worker, filer string) string {
+	name := worker + "-" + invalidNameChars.ReplaceAllString(strings.ToLower(filer), "-")
+	if len(name) <= 63 {
+		return strings.TrimRight(name, "-")
+	}
+	hash := sha256.Sum256([]byte(filer))
+	suffix := hex.EncodeToString(hash[:4])
+	return strings.TrimRight(name[:63-len(suffix)-1], "-") + "-" + suffix
+}
+
+// updateFilerWorkloads creates a deployment for every discovered filer that
+// passed probing, updates the deployments of changed filers and deletes the
+// deployments of filers that are inactive, removed, excluded or not probed
+// in the last 48 hours. It replaces updateWorkerReplica in per-filer mode.
+func (n *NetAppSD) updateFilerWorkloads(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// do not delete workloads before a full discovery has probed the
+	// filers; a single filer discovery or the loaded inventory is not enough
+	if !n.Discovered() {
+		slog.Info("skip filer workloads, filers not discovered yet")
+		return nil
+	}
+
+	deployments := n.kubeClientset.AppsV1().Deployments(n.Namespace)
+	template, err := deployments.Get(ctx, n.WorkerName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get worker template deployment: %w", err)
+	}
+	list, err := deployments.List(ctx, metav1.ListOptions{
+		LabelSelector: workerOfLabel + "=" + n.WorkerName,
+	})
+	if err != nil {
+		return err
+	}
+
+	var tpl *harvest.Template
+	if n.ConfigTemplate != nil {
+		if tpl, err = n.ConfigTemplate(ctx); err != nil {
+			n.recorder.Eventf(template, v1.EventTypeWarning, "TemplateInvalid", "Failed to load the config template: %s", err)
+			return fmt.Errorf("failed to load config template: %w", err)
+		}
+	}
+
+	if n.DryRun {
+		n.resetPlan()
+	}
+	if template, err = n.scaleDownTemplate(ctx, template); err != nil {
+		return err
+	}
+
+	existing := make(map[string]appsv1.Deployment, len(list.Items))
+	for _, d := range list.Items {
+		existing[d.Labels["filer"]] = d
+	}
+
+	for filerName, d := range existing {
+		reason := n.retireReason(filerName)
+		if reason == "" {
+			continue
+		}
+		if n.DryRun {
+			n.planAction("delete deployment", d.Name, "%s", reason)
+			delete(existing, filerName)
+			continue
+		}
+		slog.Info("delete filer worker", "filer", filerName, "deployment", d.Name, "reason", reason)
+		if err := deployments.Delete(ctx, d.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		n.recorder.Eventf(template, v1.EventTypeNormal, "WorkerDeleted", "Deleted worker %s: %s", d.Name, reason)
+		delete(existing, filerName)
+		delete(n.clusters, filerName)
+		if err := n.deleteFilerConfig(ctx, d.Name); err != nil {
+			return err
+		}
+	}
+
+	for filerName, filer := range n.filerList {
+		d, found := existing[filerName]
+		if !found {
+			if n.retireReason(filerName) != "" {
+				continue
+			}
+			// only create workloads for filers probed recently, like the queue
+			if time.Since(n.lastProbeFilerTs.LoadTime(filerName)) > n.probeStaleness() {
+				continue
+			}
+		}
+
+		desired, err := n.filerWorkload(template, filer)
+		if err != nil {
+			return err
+		}
+		var config []byte
+		if tpl != nil {
+			if config, err = n.renderFilerConfig(tpl, filer, desired.Name); err != nil {
+				slog.Warn("failed to render filer config", "filer", filerName, "error", err)
+				n.recorder.Eventf(template, v1.EventTypeWarning, "RenderFailed", "Failed to render config of filer %s: %s", filerName, err)
+				continue
+			}
+			if err := n.mountFilerConfig(desired, config); err != nil {
+				return err
+			}
+		}
+		if found {
+			if filerEnvOf(d) == filerEnvOf(*desired) &&
+				d.Annotations[templateGenerationAnnotation] == desired.Annotations[templateGenerationAnnotation] &&
+				d.Spec.Template.Annotations[configHashAnnotation] == desired.Spec.Template.Annotations[configHashAnnotation] {
+				continue
+			}
+			if n.DryRun {
+				n.planAction("update deployment", d.Name, "filer %s", filerName)
+				continue
+			}
+			if config != nil {
+				if err := n.writeFilerConfig(ctx, template, d.Name, filer, config); err != nil {
+					return err
+				}
+			}
+			if d.Annotations == nil {
+				d.Annotations = make(map[string]string)
+			}
+			d.Annotations[templateGenerationAnnotation] = desired.Annotations[templateGenerationAnnotation]
+			d.Spec.Template = desired.Spec.Template
+			slog.Info("update filer worker", "filer", filerName, "deployment", d.Name)
+			if _, err := deployments.Update(ctx, &d, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			n.recorder.Eventf(template, v1.EventTypeNormal, "WorkerUpdated", "Updated worker %s for filer %s", d.Name, filerName)
+			continue
+		}
+
+		if n.DryRun {
+			n.planAction("create deployment", desired.Name, "filer %s", filerName)
+			existing[filerName] = *desired
+			continue
+		}
+		slog.Info("create filer worker", "filer", filerName, "deployment", desired.Name)
+		if config != nil {
+			if err := n.writeFilerConfig(ctx, template, desired.Name, filer, config); err != nil {
+				return err
+			}
+		}
+		if _, err := deployments.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		n.recorder.Eventf(template, v1.EventTypeNormal, "WorkerCreated", "Created worker %s for filer %s", desired.Name, filerName)
+		existing[filerName] = *desired
+	}
+
+	workerReplicas.WithLabelValues(n.Pool).Set(float64(len(existing)))
+	return nil
+}
+
+// scaleDownTemplate scales the template worker deployment to zero replicas,
+// since its pods would only request filers via /next/filer, which is not
+// supported in per-filer mode. It returns the updated deployment.
+func (n *NetAppSD) scaleDownTemplate(ctx context.Context, template *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if template.Spec.Replicas != nil && *template.Spec.Replicas == 0 {
+		return template, nil
+	}
+	if n.DryRun {
+		n.planAction("scale deployment", template.Name, "replicas -> 0, the template of the per-filer workers")
+		return template, nil
+	}
+	slog.Info("scale down worker template", "deployment", template.Name)
+	replicas := int32(0)
+	template.Spec.Replicas = &replicas
+	template, err := n.kubeClientset.AppsV1().Deployments(n.Namespace).Update(ctx, template, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scale down worker template deployment: %w", err)
+	}
+	n.recorder.Eventf(template, v1.EventTypeNormal, "TemplateScaledDown", "Scaled down the template of the per-filer workers")
+	return template, nil
+}
+
+// retireReason returns why the worker of the filer is retired, or an empty
+// string if it is not. It must be called with n.mu held.
+func (n *NetAppSD) retireReason(filerName string) string {
+	if _, found := n.inactiveFilers[filerName]; found {
+		return fmt.Sprintf("filer %s is not active in netbox", filerName)
+	}
+	if _, found := n.removedFilers[filerName]; found {
+		return fmt.Sprintf("filer %s is removed from netbox", filerName)
+	}
+	if reason, found := n.overrides.Excluded[filerName]; found {
+		return fmt.Sprintf("filer %s is excluded: %s", filerName, reason)
+	}
+	// a filer not probed successfully since the start of the master is not
+	// stale, its last probe is not known
+	lastProbeTime := n.lastProbeFilerTs.LoadTime(filerName)
+	if n.lastProbeError == nil && lastProbeTime.Unix() > 0 && time.Since(lastProbeTime) > 48*time.Hour {
+		return fmt.Sprintf("filer %s was not probed successfully since %s", filerName, lastProbeTime.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// filerWorkload returns the deployment of the filer, which is a copy of the
+// template deployment with one replica, the filer label and the filer passed
+// in the FILER environment variable. It is owned by the template deployment,
+// so that it is deleted with it.
+func (n *NetAppSD) filerWorkload(template *appsv1.Deployment, filer Filer) (*appsv1.Deployment, error) {
+	filerJSON, err := json.Marshal(filer)
+	if err != nil {
+		return nil, err
+	}
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      filerWorkloadName(n.WorkerName, filer.Name),
+			Namespace: n.Namespace,
+			Labels:    make(map[string]string),
+			Annotations: map[string]string{
+				templateGenerationAnnotation: fmt.Sprint(template.Generation),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(template, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+			},
+		},
+		Spec: *template.Spec.DeepCopy(),
+	}
+	for k, v := range template.Labels {
+		d.Labels[k] = v
+	}
+	d.Labels[workerOfLabel] = n.WorkerName
+	d.Labels["filer"] = filer.Name
+
+	replicas := int32(1)
+	d.Spec.Replicas = &replicas
+	if d.Spec.Selector == nil {
+		d.Spec.Selector = &metav1.LabelSelector{}
+	}
+	if d.Spec.Selector.MatchLabels == nil {
+		d.Spec.Selector.MatchLabels = make(map[string]string)
+	}
+	d.Spec.Selector.MatchLabels["filer"] = filer.Name
+	if d.Spec.Template.Labels == nil {
+		d.Spec.Template.Labels = make(map[string]string)
+	}
+	d.Spec.Template.Labels["filer"] = filer.Name
+
+	for i := range d.Spec.Template.Spec.Containers {
+		c := &d.Spec.Template.Spec.Containers[i]
+		env := c.Env[:0:0]
+		for _, e := range c.Env {
+			if e.Name != filerEnv {
+				env = append(env, e)
+			}
+		}
+		c.Env = append(env, v1.EnvVar{Name: filerEnv, Value: string(filerJSON)})
+	}
+	return d, nil
+}
+
+// filerEnvOf returns the filer passed to the containers of the deployment.
+func filerEnvOf(d appsv1.Deployment) string {
+	for _, c := range d.Spec.Template.Spec.Containers {
+		for _, e := range c.Env {
+			if e.Name == filerEnv {
+				return e.Value
+			}
+		}
+	}
+	return ""
+}
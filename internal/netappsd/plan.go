@@ -0,0 +1,72 @@
+package netappsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// PlannedAction is a change the master would make, if it did not run in dry
+// run mode.
+type PlannedAction struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// planAction records the action instead of changing the cluster in dry run
+// mode.
+func (n *NetAppSD) planAction(action, target, detailFmt string, args ...any) {
+	detail := fmt.Sprintf(detailFmt, args...)
+	slog.Info("dry run: planned action", "action", action, "target", target, "detail", detail)
+	n.planMu.Lock()
+	defer n.planMu.Unlock()
+	n.plan = append(n.plan, PlannedAction{
+		Time:   time.Now(),
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// resetPlan starts the plan of a worker update.
+func (n *NetAppSD) resetPlan() {
+	n.planMu.Lock()
+	defer n.planMu.Unlock()
+	n.plan = nil
+}
+
+// Plan returns the actions planned in dry run mode by the last worker update
+// and the override changes since.
+func (n *NetAppSD) Plan() []PlannedAction {
+	n.planMu.Lock()
+	defer n.planMu.Unlock()
+	return append([]PlannedAction{}, n.plan...)
+}
+
+// planAssignments plans the filers that the free workers would get from the
+// queue, since the workers of a dry run master do not request filers. It
+// must be called with n.mu held.
+func (n *NetAppSD) planAssignments(ctx context.Context) error {
+	pods, err := n.listWorkerPods(ctx)
+	if err != nil {
+		return err
+	}
+	next := 0
+	for _, pod := range pods {
+		if next >= len(n.filerQueue) {
+			return nil
+		}
+		if _, found := pod.Labels["filer"]; found || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if _, found := n.overrides.Drained[pod.Name]; found {
+			continue
+		}
+		n.planAction("label pod", pod.Name, "filer=%s", n.filerQueue[next].Name)
+		next++
+	}
+	return nil
+}
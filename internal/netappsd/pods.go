@@ -0,0 +1,107 @@
+package netappsd
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// workerPods reads the worker pods from the cache of the pod informer, so
+// that the reconciles triggered by pod events do not list the pods from the
+// API server. The pods the master updated are assumed until the cache has
+// caught up with the update, so that e.g. a filer just assigned is not
+// queued again.
+type workerPods struct {
+	lister corelisters.PodNamespaceLister
+	synced func() bool
+
+	mu      sync.Mutex
+	assumed map[string]*v1.Pod
+}
+
+// listWorkerPods returns copies of the worker pods, sorted by name, with
+// further label requirements, e.g. "filer=<name>". It lists them from the API
+// server while the cache is not synced.
+func (n *NetAppSD) listWorkerPods(ctx context.Context, requirements ...string) ([]v1.Pod, error) {
+	if n.WorkerLabel != "" {
+		requirements = append([]string{n.WorkerLabel}, requirements...)
+	}
+	selector, err := labels.Parse(strings.Join(requirements, ","))
+	if err != nil {
+		return nil, err
+	}
+	p := &n.pods
+	if p.lister == nil || !p.synced() {
+		list, err := n.kubeClientset.CoreV1().Pods(n.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: selector.String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return list.Items, nil
+	}
+	// the informer only watches the worker pods; the assumed labels may
+	// differ from the cached ones
+	cached, err := p.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pods := make([]v1.Pod, 0, len(cached))
+	seen := make(map[string]struct{}, len(cached))
+	for _, pod := range cached {
+		seen[pod.Name] = struct{}{}
+		if assumed, found := p.assumed[pod.Name]; found {
+			if cachedUpdate(pod, assumed) {
+				delete(p.assumed, pod.Name)
+			} else {
+				pod = assumed
+			}
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, *pod.DeepCopy())
+		}
+	}
+	for name := range p.assumed {
+		if _, found := seen[name]; !found {
+			delete(p.assumed, name)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// assumePod records the pod returned by an update of the master, until the
+// cache of the pod informer has it.
+func (n *NetAppSD) assumePod(pod *v1.Pod) {
+	p := &n.pods
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.assumed == nil {
+		p.assumed = make(map[string]*v1.Pod)
+	}
+	p.assumed[pod.Name] = pod.DeepCopy()
+}
+
+// cachedUpdate reports whether the cached pod has the update of the assumed
+// pod, or a later one. The resource version is opaque, but numeric in
+// etcd-backed API servers; otherwise, e.g. with a fake client, the labels and
+// annotations are compared.
+func cachedUpdate(cached, assumed *v1.Pod) bool {
+	cachedRV, err1 := strconv.ParseUint(cached.ResourceVersion, 10, 64)
+	assumedRV, err2 := strconv.ParseUint(assumed.ResourceVersion, 10, 64)
+	if err1 == nil && err2 == nil {
+		return cachedRV >= assumedRV
+	}
+	return maps.Equal(cached.Labels, assumed.Labels) && maps.Equal(cached.Annotations, assumed.Annotations)
+}
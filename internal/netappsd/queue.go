@@ -0,0 +1,131 @@
+package netappsd
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// QueuePolicy orders the filer queue in shared worker mode. Filers are
+// ordered by priority tag, then by priority field, then production before lab
+// filers, and then by the time they are unassigned, longest first. With
+// AZFairness, the availability zones take turns among filers of the same
+// priority.
+type QueuePolicy struct {
+	// PriorityTags are netbox tags in order of priority. Filers with the
+	// first tag come first, filers without any of them last.
+	PriorityTags []string
+	// PriorityField is a netbox custom field with a numeric priority. Higher
+	// priorities come first, filers without it count as 0.
+	PriorityField string
+	// LabTag is the netbox tag of lab filers, which come after production
+	// filers of the same priority.
+	LabTag string
+	// AZFairness lets the availability zones take turns.
+	AZFairness bool
+}
+
+// queueRank is the priority of a filer in the queue; filers of the same rank
+// are ordered by AZ turn and unassigned time.
+type queueRank struct {
+	tag   int
+	field float64
+	lab   bool
+}
+
+func (p QueuePolicy) rank(f Filer) queueRank {
+	r := queueRank{tag: len(p.PriorityTags)}
+	for i, tag := range p.PriorityTags {
+		if netbox.Filer(f).HasTag(tag) {
+			r.tag = i
+			break
+		}
+	}
+	if p.PriorityField != "" {
+		if v, err := strconv.ParseFloat(f.CustomFields[p.PriorityField], 64); err == nil {
+			r.field = v
+		}
+	}
+	r.lab = p.LabTag != "" && netbox.Filer(f).HasTag(p.LabTag)
+	return r
+}
+
+func (r queueRank) before(o queueRank) bool {
+	if r.tag != o.tag {
+		return r.tag < o.tag
+	}
+	if r.field != o.field {
+		return r.field > o.field
+	}
+	return !r.lab && o.lab
+}
+
+// sortFilerQueue orders the filer queue by the queue policy. It must be
+// called with n.mu held.
+func (n *NetAppSD) sortFilerQueue() {
+	queue := n.filerQueue
+	ranks := make(map[string]queueRank, len(queue))
+	for _, f := range queue {
+		ranks[f.Name] = n.QueuePolicy.rank(f)
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		ri, rj := ranks[queue[i].Name], ranks[queue[j].Name]
+		if ri != rj {
+			return ri.before(rj)
+		}
+		si, sj := n.unassignedSince[queue[i].Name], n.unassignedSince[queue[j].Name]
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		return queue[i].Name < queue[j].Name
+	})
+	if !n.QueuePolicy.AZFairness {
+		return
+	}
+
+	// the n-th filer of an AZ in a rank gets the n-th turn
+	turns := make(map[string]int, len(queue))
+	seen := make(map[queueRank]map[string]int)
+	for _, f := range queue {
+		r := ranks[f.Name]
+		if seen[r] == nil {
+			seen[r] = make(map[string]int)
+		}
+		turns[f.Name] = seen[r][f.AvailabilityZone]
+		seen[r][f.AvailabilityZone]++
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		ri, rj := ranks[queue[i].Name], ranks[queue[j].Name]
+		if ri != rj {
+			return ri.before(rj)
+		}
+		return turns[queue[i].Name] < turns[queue[j].Name]
+	})
+}
+
+// updateUnassigned tracks since when the filers are not assigned to a worker
+// and updates the unassigned seconds of the queued filers. It must be called
+// with n.mu held.
+func (n *NetAppSD) updateUnassigned(filerInWorkers map[string]struct{}) {
+	now := time.Now()
+	for filerName := range n.unassignedSince {
+		_, assigned := filerInWorkers[filerName]
+		_, discovered := n.filerList[filerName]
+		if assigned || !discovered {
+			delete(n.unassignedSince, filerName)
+		}
+	}
+	filerUnassignedSeconds.DeletePartialMatch(prometheus.Labels{"pool": n.Pool})
+	for _, f := range n.filerQueue {
+		since, found := n.unassignedSince[f.Name]
+		if !found {
+			since = now
+			n.unassignedSince[f.Name] = since
+		}
+		filerUnassignedSeconds.WithLabelValues(n.Pool, f.Name).Set(now.Sub(since).Seconds())
+	}
+}
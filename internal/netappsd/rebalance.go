@@ -0,0 +1,159 @@
+package netappsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// zoneLabel is the node label with the availability zone of the node.
+	zoneLabel = "topology.kubernetes.io/zone"
+	// rebalanceTimeout is the time a free worker has to take over a moved
+	// filer, before the move is aborted.
+	rebalanceTimeout = 5 * time.Minute
+)
+
+// filerMove is a filer the rebalancer moves from one worker to another. The
+// old worker keeps the filer until the new worker has taken it over.
+type filerMove struct {
+	Filer   string
+	From    string
+	To      string
+	Started time.Time
+}
+
+// rebalance moves filers, one at a time and at most one per
+// RebalanceInterval, to free workers in the availability zone of the filer.
+// The filer is reserved for the new worker, which gets it on its next
+// request and is counted in the desired workers, so that it is neither
+// retired nor taken by a queued filer. Once the new worker has taken the
+// filer over, the old worker is drained and deleted, and the worker
+// deployment scaled down by one, so that the filer is never left unscraped
+// and the old worker is not replaced. It must be called with n.mu held.
+func (n *NetAppSD) rebalance(ctx context.Context) error {
+	pods, err := n.listWorkerPods(ctx)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]v1.Pod, len(pods))
+	for _, pod := range pods {
+		byName[pod.Name] = pod
+	}
+
+	if m := n.move; m != nil {
+		from, fromFound := byName[m.From]
+		to, toFound := byName[m.To]
+		switch {
+		case toFound && to.Labels["filer"] == m.Filer:
+			slog.Info("filer moved", "filer", m.Filer, "from", m.From, "to", m.To)
+			rebalanceMoves.WithLabelValues(n.Pool, "completed").Inc()
+			n.move = nil
+			if fromFound && from.Labels["filer"] == m.Filer {
+				if err := n.drainPod(ctx, m.From, fmt.Sprintf("filer %s moved to %s", m.Filer, m.To)); err != nil {
+					return err
+				}
+				if n.Replicas != ReplicasExternal {
+					return n.scaleDownWorkers(ctx, 1)
+				}
+			}
+		case !fromFound || from.Labels["filer"] != m.Filer || !toFound || to.DeletionTimestamp != nil || time.Since(m.Started) > rebalanceTimeout:
+			slog.Warn("abort filer move", "filer", m.Filer, "from", m.From, "to", m.To)
+			rebalanceMoves.WithLabelValues(n.Pool, "aborted").Inc()
+			n.move = nil
+		}
+		return nil
+	}
+	// queued filers get the free workers first
+	if len(n.filerQueue) > 0 || time.Since(n.lastMove) < n.RebalanceInterval {
+		return nil
+	}
+
+	// free workers by availability zone
+	free := make(map[string][]string)
+	for _, pod := range pods {
+		if _, found := pod.Labels["filer"]; found || pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		if _, found := n.overrides.Drained[pod.Name]; found {
+			continue
+		}
+		if zone := n.nodeZone(ctx, pod.Spec.NodeName); zone != "" {
+			free[zone] = append(free[zone], pod.Name)
+		}
+	}
+	if len(free) == 0 {
+		return nil
+	}
+
+	for _, pod := range pods {
+		filerName, found := pod.Labels["filer"]
+		if !found || pod.DeletionTimestamp != nil {
+			continue
+		}
+		filer, found := n.filerList[filerName]
+		if !found || filer.AvailabilityZone == "" || n.retireReason(filerName) != "" {
+			continue
+		}
+		if _, pinned := n.overrides.Pinned[filerName]; pinned {
+			continue
+		}
+		zone := n.nodeZone(ctx, pod.Spec.NodeName)
+		if zone == "" || zone == filer.AvailabilityZone || len(free[filer.AvailabilityZone]) == 0 {
+			continue
+		}
+		to := free[filer.AvailabilityZone][0]
+		if n.DryRun {
+			n.planAction("move filer", filerName, "from %s in %s to %s in %s", pod.Name, zone, to, filer.AvailabilityZone)
+			return nil
+		}
+		slog.Info("move filer", "filer", filerName, "from", pod.Name, "zone", zone, "to", to, "filerZone", filer.AvailabilityZone)
+		n.move = &filerMove{Filer: filerName, From: pod.Name, To: to, Started: time.Now()}
+		n.lastMove = n.move.Started
+		rebalanceMoves.WithLabelValues(n.Pool, "started").Inc()
+		n.recordDeploymentEvent(ctx, v1.EventTypeNormal, "FilerRebalancing", "Moving filer %s from worker %s in %s to worker %s in %s", filerName, pod.Name, zone, to, filer.AvailabilityZone)
+		return nil
+	}
+	return nil
+}
+
+// nodeZone returns the availability zone of the node, or an empty string if
+// it is not known. The zones of nodes are cached.
+func (n *NetAppSD) nodeZone(ctx context.Context, nodeName string) string {
+	if nodeName == "" {
+		return ""
+	}
+	if zone, found := n.nodeZones[nodeName]; found {
+		return zone
+	}
+	node, err := n.kubeClientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		slog.Warn("failed to get zone of node", "node", nodeName, "error", err)
+		return ""
+	}
+	n.nodeZones[nodeName] = node.Labels[zoneLabel]
+	return n.nodeZones[nodeName]
+}
+
+// movedFiler returns the filer the rebalancer moves to the pod, if any. It
+// must be called with n.mu held.
+func (n *NetAppSD) movedFiler(podName string) (Filer, bool) {
+	if n.move == nil || n.move.To != podName {
+		return Filer{}, false
+	}
+	filer, found := n.filerList[n.move.Filer]
+	if !found {
+		return Filer{}, false
+	}
+	for _, f := range n.filerQueue {
+		if f.Name == filer.Name {
+			// the old worker lost the filer, it is assigned from the queue
+			return Filer{}, false
+		}
+	}
+	return filer, true
+}
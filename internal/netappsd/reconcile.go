@@ -0,0 +1,172 @@
+package netappsd
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Reconcile keys of the work queue. The queue deduplicates keys, so that
+// events that arrive while a reconcile is pending are merged.
+const (
+	// reconcileDiscovery discovers and probes the filers.
+	reconcileDiscovery = "discovery"
+	// reconcileWorkers updates the filer queue and the workers.
+	reconcileWorkers = "workers"
+	// reconcileFilerPrefix followed by a filer name discovers and probes
+	// that filer only.
+	reconcileFilerPrefix = "filer/"
+)
+
+const (
+	// podEventDelay batches the pod events of e.g. a rollout into one
+	// reconcile.
+	podEventDelay = time.Second
+)
+
+// startReconcile starts the work queue, its two workers and the watch of the
+// worker pods, whose cache the reconciles read the pods from. The discovery
+// and the worker update run concurrently, but each of them at most once at a
+// time. Failed reconciles are retried with exponential backoff. The queue is
+// shut down when the context is done, and Wait returns once the running
+// reconciles are finished and the metrics of the pool are deleted.
+func (n *NetAppSD) startReconcile(ctx context.Context) {
+	n.queue = workqueue.NewRateLimitingQueueWithConfig(
+		workqueue.NewItemExponentialFailureRateLimiter(min(5*time.Second, n.UpdateInterval), n.DiscoveryInterval),
+		workqueue.RateLimitingQueueConfig{Name: "netappsd"},
+	)
+	n.queue.Add(reconcileDiscovery)
+	n.queue.Add(reconcileWorkers)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(n.kubeClientset, 0,
+		informers.WithNamespace(n.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = n.WorkerLabel
+		}))
+	onPodEvent := func(obj any) {
+		if pod, ok := obj.(*v1.Pod); ok {
+			slog.Debug("worker pod changed", "pod", pod.Name)
+		}
+		n.queue.AddAfter(reconcileWorkers, podEventDelay)
+	}
+	podInformer := factory.Core().V1().Pods()
+	n.pods.lister = podInformer.Lister().Pods(n.Namespace)
+	n.pods.synced = podInformer.Informer().HasSynced
+	_, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    onPodEvent,
+		UpdateFunc: func(_, obj any) { onPodEvent(obj) },
+		DeleteFunc: onPodEvent,
+	})
+	if err != nil {
+		slog.Warn("failed to watch worker pods, update workers every interval only", "interval", n.UpdateInterval, "error", err)
+	}
+	factory.Start(ctx.Done())
+
+	var workers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n.processNextKey(ctx) {
+			}
+		}()
+	}
+	// Wait returns after the metrics of the pool are deleted, so that a new
+	// master of the pool does not lose its series
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		<-ctx.Done()
+		slog.Info("stop reconcile", "queued", n.queue.Len())
+		n.queue.ShutDown()
+		factory.Shutdown()
+		// wait for the reconciles, which record events and set metrics
+		workers.Wait()
+		if n.broadcaster != nil {
+			n.broadcaster.Shutdown()
+		}
+		deletePoolMetrics(n.Pool)
+	}()
+}
+
+// processNextKey runs the reconcile of the next key. It returns false when
+// the queue is shut down.
+func (n *NetAppSD) processNextKey(ctx context.Context) bool {
+	item, shutdown := n.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer n.queue.Done(item)
+	key := item.(string)
+
+	var err error
+	var interval time.Duration
+	switch key {
+	case reconcileDiscovery:
+		interval = n.DiscoveryInterval
+		err = n.reconcileDiscovery(ctx)
+	case reconcileWorkers:
+		interval = n.UpdateInterval
+		if n.WorkerMode == WorkerModePerFiler {
+			err = n.updateFilerWorkloads(ctx)
+		} else {
+			err = n.updateWorkerReplica(ctx)
+		}
+	default:
+		// a single filer is not discovered again periodically
+		if filerName, found := strings.CutPrefix(key, reconcileFilerPrefix); found {
+			err = n.discoverFiler(ctx, filerName)
+			n.refreshWorkers(ctx)
+		}
+	}
+	if ctx.Err() != nil {
+		return true
+	}
+	if err != nil {
+		slog.Error("reconcile failed", "key", key, "retries", n.queue.NumRequeues(item), "error", err)
+		n.queue.AddRateLimited(item)
+		return true
+	}
+	n.queue.Forget(item)
+	if interval > 0 {
+		n.queue.AddAfter(item, interval)
+	}
+	return true
+}
+
+// reconcileDiscovery discovers the filers and updates the workers right
+// after a successful discovery.
+func (n *NetAppSD) reconcileDiscovery(ctx context.Context) error {
+	success, failed, err := n.discoverFilers(ctx)
+	n.refreshWorkers(ctx)
+	n.lastProbeError = err
+	if err != nil {
+		return err
+	}
+	slog.Info("filer discovery done", "success", success, "failed", failed)
+	n.discovered.Store(true)
+	n.queue.Add(reconcileWorkers)
+	return nil
+}
+
+// reconcileWorkersSoon requests an update of the workers, e.g. after the
+// overrides changed.
+func (n *NetAppSD) reconcileWorkersSoon() {
+	if n.queue != nil {
+		n.queue.Add(reconcileWorkers)
+	}
+}
+
+// Wait blocks until the reconciles are finished and the metrics of the pool
+// are deleted after the context passed to Run is done.
+func (n *NetAppSD) Wait() {
+	n.wg.Wait()
+}
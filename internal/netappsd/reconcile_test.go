@@ -0,0 +1,24 @@
+package netappsd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWaitDeletesPoolMetrics(t *testing.T) {
+	n, _ := newTestMaster(t, 1, nil)
+	n.Pool = "netapp-exporters/test"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := n.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	workerReplicas.WithLabelValues(n.Pool).Set(1)
+	cancel()
+	n.Wait()
+
+	// a new master of the pool may set its metrics right after Wait
+	if workerReplicas.DeleteLabelValues(n.Pool) {
+		t.Fatal("worker replicas of the pool not deleted after Wait")
+	}
+}
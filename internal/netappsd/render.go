@@ -0,0 +1,143 @@
+package netappsd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sapcc/netappsd/internal/pkg/harvest"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// configHashAnnotation is set on the pod template of a per-filer deployment,
+// so that changes of the rendered config roll out the pod.
+const configHashAnnotation = "netappsd/config-hash"
+
+// configSecretName returns the name of the secret with the rendered config of
+// a per-filer deployment.
+func configSecretName(workloadName string) string {
+	return workloadName + "-config"
+}
+
+// renderFilerConfig renders the harvest config of the filer. The pod of the
+// template data is the per-filer deployment, since the pod name is not known
+// before the pod is created. The ONTAP cluster information is queried during
+// discovery and left empty until the filer could be queried. It must be
+// called with n.mu held.
+func (n *NetAppSD) renderFilerConfig(tpl *harvest.Template, filer Filer, workloadName string) ([]byte, error) {
+	data := harvest.TemplateData{
+		Filer: netbox.Filer(filer),
+		Credentials: harvest.Credentials{
+			Username: n.NetAppUsername,
+			Password: n.NetAppPassword,
+		},
+		Region: n.Region,
+		Pod: harvest.Pod{
+			Name:      workloadName,
+			Namespace: n.Namespace,
+		},
+		Labels: n.ConfigLabels,
+	}
+	if data.Labels == nil {
+		data.Labels = make(map[string]string)
+	}
+	data.Cluster = n.clusters[filer.Name]
+	return tpl.Render(data)
+}
+
+// mountFilerConfig replaces the config volume of the per-filer deployment
+// with the secret of the rendered config, which contains "<filer>.yaml". It
+// removes the netappsd worker containers, which would fail to write the
+// config to the read-only secret volume.
+func (n *NetAppSD) mountFilerConfig(d *appsv1.Deployment, config []byte) error {
+	containers := d.Spec.Template.Spec.Containers[:0:0]
+	for _, c := range d.Spec.Template.Spec.Containers {
+		if isWorkerContainer(c) {
+			slog.Debug("remove worker container from rendered deployment", "deployment", d.Name, "container", c.Name)
+			continue
+		}
+		containers = append(containers, c)
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("worker deployment %s has no container besides the netappsd worker", n.WorkerName)
+	}
+	d.Spec.Template.Spec.Containers = containers
+
+	volumes := d.Spec.Template.Spec.Volumes
+	found := false
+	for i := range volumes {
+		if volumes[i].Name == n.ConfigVolume {
+			volumes[i].VolumeSource = v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{SecretName: configSecretName(d.Name)},
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("worker deployment %s has no volume %s to mount the config", n.WorkerName, n.ConfigVolume)
+	}
+	hash := sha256.Sum256(config)
+	if d.Spec.Template.Annotations == nil {
+		d.Spec.Template.Annotations = make(map[string]string)
+	}
+	d.Spec.Template.Annotations[configHashAnnotation] = hex.EncodeToString(hash[:8])
+	return nil
+}
+
+// writeFilerConfig creates or updates the secret of the rendered config. It
+// is owned by the template deployment, like the per-filer deployment.
+func (n *NetAppSD) writeFilerConfig(ctx context.Context, template *appsv1.Deployment, workloadName string, filer Filer, config []byte) error {
+	secrets := n.kubeClientset.CoreV1().Secrets(n.Namespace)
+	secret, err := secrets.Get(ctx, configSecretName(workloadName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      configSecretName(workloadName),
+				Namespace: n.Namespace,
+				Labels: map[string]string{
+					workerOfLabel: n.WorkerName,
+					"filer":       filer.Name,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(template, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+				},
+			},
+			Data: map[string][]byte{filer.Name + ".yaml": config},
+		}
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	secret.Data = map[string][]byte{filer.Name + ".yaml": config}
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+func (n *NetAppSD) deleteFilerConfig(ctx context.Context, workloadName string) error {
+	err := n.kubeClientset.CoreV1().Secrets(n.Namespace).Delete(ctx, configSecretName(workloadName), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// isWorkerContainer reports whether the container runs "netappsd worker",
+// either with the netappsd command or the entrypoint of the netappsd image.
+func isWorkerContainer(c v1.Container) bool {
+	argv := append(append([]string(nil), c.Command...), c.Args...)
+	if len(c.Command) == 0 && strings.Contains(c.Image, "netappsd") {
+		argv = append([]string{"netappsd"}, argv...)
+	}
+	return len(argv) > 1 && path.Base(argv[0]) == "netappsd" && argv[1] == "worker"
+}
@@ -0,0 +1,108 @@
+package netappsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Retirement strategies of the workers in shared worker mode.
+const (
+	// RetireDeletionCost marks retired workers with a pod deletion cost of
+	// -999 and scales down the worker deployment, so that the ReplicaSet
+	// controller deletes them first. It only runs while no filer is queued;
+	// until then, the workers of removed filers are deleted and replaced.
+	RetireDeletionCost = "deletion-cost"
+	// RetireEvict evicts retired workers through the Eviction API, which
+	// honours PodDisruptionBudgets, and then scales down the worker
+	// deployment. It runs while filers are queued, but keeps the workers
+	// without filer for them.
+	RetireEvict = "evict"
+)
+
+func validateRetire(retire string) error {
+	switch retire {
+	case RetireDeletionCost, RetireEvict:
+		return nil
+	}
+	return fmt.Errorf("unknown retirement strategy %s", retire)
+}
+
+// workerRetireReason returns why the worker pod is retired, or an empty
+// string if it is not. Workers without filer are only retired if no filer is
+// queued, and not while the rebalancer moves a filer to them. It must be
+// called with n.mu held.
+func (n *NetAppSD) workerRetireReason(pod v1.Pod) string {
+	if filerName, found := pod.Labels["filer"]; found {
+		return n.retireReason(filerName)
+	}
+	if len(n.filerQueue) > 0 || (n.move != nil && n.move.To == pod.Name) {
+		return ""
+	}
+	return "worker has no filer"
+}
+
+// evictWorkers evicts the retired worker pods and returns the number of pods
+// evicted. Pods whose eviction is blocked by a PodDisruptionBudget, or that
+// can not be removed from the worker deployment due to the scale guardrails,
+// are retried on the next update. It skips the pods that are being deleted.
+func (n *NetAppSD) evictWorkers(ctx context.Context) (int, error) {
+	workerPods, err := n.listWorkerPods(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var retired []v1.Pod
+	for _, pod := range workerPods {
+		if pod.DeletionTimestamp != nil {
+			slog.Info("skip terminating pod", "pod", pod.Name)
+			continue
+		}
+		if n.workerRetireReason(pod) != "" {
+			retired = append(retired, pod)
+		}
+	}
+	if len(retired) > 0 && n.Replicas != ReplicasExternal {
+		// evicted workers are replaced, unless the replicas are lowered
+		allowed, err := n.scaleDownAllowance(ctx, len(retired))
+		if err != nil {
+			return 0, err
+		}
+		if allowed < len(retired) {
+			slog.Info("defer eviction of workers", "retired", len(retired), "allowed", allowed)
+			retired = retired[:allowed]
+		}
+	}
+
+	cnt := 0
+	for _, pod := range retired {
+		retireReason := n.workerRetireReason(pod)
+		if n.DryRun {
+			n.planAction("evict worker", pod.Name, "%s", retireReason)
+			cnt++
+			continue
+		}
+		slog.Info("evict worker", "filer", pod.Labels["filer"], "pod", pod.Name, "reason", retireReason)
+		err := n.kubeClientset.PolicyV1().Evictions(n.Namespace).Evict(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		})
+		switch {
+		case apierrors.IsTooManyRequests(err):
+			// the eviction would violate a PodDisruptionBudget
+			slog.Warn("eviction of worker blocked", "pod", pod.Name, "error", err)
+			n.recorder.Eventf(&pod, v1.EventTypeWarning, "EvictionBlocked", "Eviction of retired worker blocked: %s", err)
+			continue
+		case apierrors.IsNotFound(err):
+			continue
+		case err != nil:
+			return cnt, err
+		}
+		n.recorder.Eventf(&pod, v1.EventTypeNormal, "WorkerEvicted", "Evicted worker: %s", retireReason)
+		cnt++
+	}
+	return cnt, nil
+}
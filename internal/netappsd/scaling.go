@@ -0,0 +1,136 @@
+package netappsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Replica management of the worker deployment in shared worker mode.
+const (
+	// ReplicasMaster lets the master set the replicas of the worker
+	// deployment.
+	ReplicasMaster = "master"
+	// ReplicasExternal leaves the replicas to an autoscaler, e.g. a
+	// HorizontalPodAutoscaler on the desired workers reported by the
+	// external metrics API. The master still marks retired workers for
+	// deletion.
+	ReplicasExternal = "external"
+)
+
+// Scaling is the number of workers the master wants.
+type Scaling struct {
+	// Desired is the number of workers needed: Assigned + Queued + Moving.
+	Desired int `json:"desired"`
+	// Assigned is the number of workers with a filer that is not retired.
+	Assigned int `json:"assigned"`
+	// Queued is the number of filers waiting for a worker.
+	Queued int `json:"queued"`
+	// Moving is the number of workers the rebalancer moves a filer to.
+	Moving int `json:"moving,omitempty"`
+}
+
+// Scaling returns the number of workers the master wants, as of the last
+// worker update.
+func (n *NetAppSD) Scaling() Scaling {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.scaling
+}
+
+// updateScaling counts the workers needed for the filers in workers and in
+// the queue. It must be called with n.mu held.
+func (n *NetAppSD) updateScaling(filerInWorkers map[string]struct{}) {
+	s := Scaling{Queued: len(n.filerQueue)}
+	for filerName := range filerInWorkers {
+		if n.retireReason(filerName) == "" {
+			s.Assigned++
+		}
+	}
+	if n.move != nil {
+		s.Moving = 1
+	}
+	s.Desired = s.Assigned + s.Queued + s.Moving
+	if s != n.scaling {
+		slog.Info("desired workers changed", "desired", s.Desired, "assigned", s.Assigned, "queued", s.Queued, "moving", s.Moving)
+	}
+	n.scaling = s
+	desiredWorkers.WithLabelValues(n.Pool).Set(float64(s.Desired))
+}
+
+// limitReplicas applies the scale guardrails to the target replicas of the
+// worker deployment, see replicaLimit. Every guardrail that limits the target
+// is logged and counted. It must be called with n.mu held.
+func (n *NetAppSD) limitReplicas(current, target int32) int32 {
+	limited, guardrails := n.replicaLimit(current, target)
+	for _, guardrail := range guardrails {
+		slog.Warn("worker scaling limited", "limit", guardrail, "current", current, "target", target, "limited", limited)
+		scaleLimited.WithLabelValues(n.Pool, guardrail).Inc()
+	}
+	return limited
+}
+
+// replicaLimit returns the target replicas of the worker deployment limited
+// by the scale guardrails: the cooldowns, the step limits and the min and max
+// replicas, and the guardrails that limited it. It must be called with n.mu
+// held.
+func (n *NetAppSD) replicaLimit(current, target int32) (int32, []string) {
+	var guardrails []string
+	limit := func(guardrail string, limited int32) {
+		guardrails = append(guardrails, guardrail)
+		target = limited
+	}
+	switch {
+	case target > current:
+		if n.ScaleUpCooldown > 0 && time.Since(n.lastScaleUp) < n.ScaleUpCooldown {
+			limit("scale_up_cooldown", current)
+			return target, guardrails
+		}
+		if n.MaxScaleUp > 0 && target-current > n.MaxScaleUp {
+			limit("max_scale_up", current+n.MaxScaleUp)
+		}
+		if n.MaxReplicas > 0 && target > n.MaxReplicas {
+			limit("max_replicas", max(n.MaxReplicas, current))
+		}
+	case target < current:
+		lastScale := n.lastScaleUp
+		if n.lastScaleDown.After(lastScale) {
+			lastScale = n.lastScaleDown
+		}
+		if n.ScaleDownCooldown > 0 && time.Since(lastScale) < n.ScaleDownCooldown {
+			limit("scale_down_cooldown", current)
+			return target, guardrails
+		}
+		if n.MaxScaleDown > 0 && current-target > n.MaxScaleDown {
+			limit("max_scale_down", current-n.MaxScaleDown)
+		}
+		if target < n.MinReplicas {
+			limit("min_replicas", min(n.MinReplicas, current))
+		}
+	}
+	return target, guardrails
+}
+
+// scaleDownAllowance returns how many of count workers may be removed from
+// the worker deployment in this update. It does not report the guardrails,
+// which scaleDownWorkers does. It must be called with n.mu held.
+func (n *NetAppSD) scaleDownAllowance(ctx context.Context, count int) (int, error) {
+	workerDeployment, err := n.kubeClientset.AppsV1().Deployments(n.Namespace).Get(ctx, n.WorkerName, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	currentReplicas := *workerDeployment.Spec.Replicas
+	limited, _ := n.replicaLimit(currentReplicas, int32(int(currentReplicas)-count))
+	return int(currentReplicas - limited), nil
+}
+
+func validateReplicas(replicas string) error {
+	switch replicas {
+	case ReplicasMaster, ReplicasExternal:
+		return nil
+	}
+	return fmt.Errorf("unknown replica management %s", replicas)
+}
@@ -0,0 +1,107 @@
+package netappsd
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Status is the state of the master, as returned by the /status endpoint.
+type Status struct {
+	// Filers are the discovered filers that passed probing.
+	Filers []FilerStatus `json:"filers"`
+	// Queue are the filers waiting for a worker, in assignment order.
+	Queue []string `json:"queue"`
+	// Workers are the worker pods and their filers.
+	Workers []WorkerStatus `json:"workers"`
+	// ProbeFailures are the filers that failed the last probe, with the
+	// error.
+	ProbeFailures map[string]string `json:"probe_failures"`
+	// Inactive are the filers that are not active in netbox.
+	Inactive []string `json:"inactive"`
+	// Unassigned are the discovered filers without a worker.
+	Unassigned []string `json:"unassigned"`
+	// Overrides are the manual pins, exclusions and drains.
+	Overrides Overrides `json:"overrides"`
+	// NetboxError is set while netbox is unreachable.
+	NetboxError string `json:"netbox_error,omitempty"`
+}
+
+type FilerStatus struct {
+	Filer
+	LastProbe time.Time `json:"last_probe"`
+	Worker    string    `json:"worker,omitempty"`
+}
+
+type WorkerStatus struct {
+	Pod      string `json:"pod"`
+	Filer    string `json:"filer,omitempty"`
+	Phase    string `json:"phase"`
+	Deleting bool   `json:"deleting,omitempty"`
+}
+
+// Status returns the current state of discovery, queue and workers.
+func (n *NetAppSD) Status(ctx context.Context) (*Status, error) {
+	pods, err := n.listWorkerPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := n.Overrides()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := &Status{
+		Overrides:     overrides,
+		Filers:        make([]FilerStatus, 0, len(n.filerList)),
+		Queue:         make([]string, 0, len(n.filerQueue)),
+		Workers:       make([]WorkerStatus, 0, len(pods)),
+		ProbeFailures: make(map[string]string, len(n.probeErrors)),
+		Inactive:      make([]string, 0, len(n.inactiveFilers)),
+		Unassigned:    make([]string, 0),
+	}
+	if err := n.NetboxError(); err != nil {
+		status.NetboxError = err.Error()
+	}
+
+	workerOfFiler := make(map[string]string)
+	for _, pod := range pods {
+		filerName := pod.Labels["filer"]
+		if filerName != "" {
+			workerOfFiler[filerName] = pod.Name
+		}
+		status.Workers = append(status.Workers, WorkerStatus{
+			Pod:      pod.Name,
+			Filer:    filerName,
+			Phase:    string(pod.Status.Phase),
+			Deleting: pod.DeletionTimestamp != nil,
+		})
+	}
+	sort.Slice(status.Workers, func(i, j int) bool { return status.Workers[i].Pod < status.Workers[j].Pod })
+
+	for name, filer := range n.filerList {
+		status.Filers = append(status.Filers, FilerStatus{
+			Filer:     filer,
+			LastProbe: n.lastProbeFilerTs.LoadTime(name),
+			Worker:    workerOfFiler[name],
+		})
+		if _, found := workerOfFiler[name]; !found {
+			status.Unassigned = append(status.Unassigned, name)
+		}
+	}
+	sort.Slice(status.Filers, func(i, j int) bool { return status.Filers[i].Name < status.Filers[j].Name })
+	sort.Strings(status.Unassigned)
+
+	for _, f := range n.filerQueue {
+		status.Queue = append(status.Queue, f.Name)
+	}
+	for name, err := range n.probeErrors {
+		status.ProbeFailures[name] = err
+	}
+	for name := range n.inactiveFilers {
+		status.Inactive = append(status.Inactive, name)
+	}
+	sort.Strings(status.Inactive)
+	return status, nil
+}
@@ -0,0 +1,114 @@
+package harvest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the part of the harvest.yml schema that netappsd renders.
+//
+// EG https://netapp.github.io/harvest/latest/configure-harvest-basic/
+type Config struct {
+	Admin     map[string]interface{} `json:"Admin,omitempty"`
+	Tools     map[string]interface{} `json:"Tools,omitempty"`
+	Exporters map[string]Exporter    `json:"Exporters,omitempty"`
+	Defaults  *Poller                `json:"Defaults,omitempty"`
+	Pollers   map[string]*Poller     `json:"Pollers,omitempty"`
+}
+
+type Exporter struct {
+	Exporter     string `json:"exporter"`
+	Addr         string `json:"addr,omitempty"`
+	Port         int    `json:"port,omitempty"`
+	PortRange    string `json:"port_range,omitempty"`
+	GlobalPrefix string `json:"global_prefix,omitempty"`
+}
+
+type Poller struct {
+	Addr           string              `json:"addr,omitempty"`
+	Datacenter     string              `json:"datacenter,omitempty"`
+	AuthStyle      string              `json:"auth_style,omitempty"`
+	Username       string              `json:"username,omitempty"`
+	Password       string              `json:"password,omitempty"`
+	UseInsecureTLS *bool               `json:"use_insecure_tls,omitempty"`
+	Exporters      []string            `json:"exporters,omitempty"`
+	Collectors     []interface{}       `json:"collectors,omitempty"`
+	Labels         []map[string]string `json:"labels,omitempty"`
+}
+
+var exporterTypes = map[string]struct{}{
+	"Prometheus": {},
+	"InfluxDB":   {},
+}
+
+// ValidateConfig checks that b is a harvest config: it must be valid YAML,
+// must not have unknown top level sections, and every poller must have an
+// address, collectors and exporters that are defined in the config.
+func ValidateConfig(b []byte) error {
+	var top map[string]interface{}
+	if err := yaml.Unmarshal(b, &top); err != nil {
+		return fmt.Errorf("invalid yaml: %w", err)
+	}
+	for section := range top {
+		switch section {
+		case "Admin", "Tools", "Exporters", "Defaults", "Pollers":
+		default:
+			return fmt.Errorf("unknown section %s", section)
+		}
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("invalid harvest config: %w", err)
+	}
+	if len(cfg.Pollers) == 0 {
+		return errors.New("no pollers defined")
+	}
+	for name, exporter := range cfg.Exporters {
+		if _, found := exporterTypes[exporter.Exporter]; !found {
+			return fmt.Errorf("exporter %s: unknown type %q", name, exporter.Exporter)
+		}
+	}
+
+	defaults := cfg.Defaults
+	if defaults == nil {
+		defaults = new(Poller)
+	}
+	names := make([]string, 0, len(cfg.Pollers))
+	for name := range cfg.Pollers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := cfg.Pollers[name]
+		if p == nil {
+			p = new(Poller)
+		}
+		if p.Addr == "" && defaults.Addr == "" {
+			return fmt.Errorf("poller %s: no addr", name)
+		}
+		collectors := p.Collectors
+		if len(collectors) == 0 {
+			collectors = defaults.Collectors
+		}
+		if len(collectors) == 0 {
+			return fmt.Errorf("poller %s: no collectors", name)
+		}
+		exporters := p.Exporters
+		if len(exporters) == 0 {
+			exporters = defaults.Exporters
+		}
+		if len(exporters) == 0 {
+			return fmt.Errorf("poller %s: no exporters", name)
+		}
+		for _, e := range exporters {
+			if _, found := cfg.Exporters[e]; !found {
+				return fmt.Errorf("poller %s: exporter %s is not defined", name, e)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package harvest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// FuncMap returns the functions available in harvest config templates. They
+// follow the naming of the sprig library, which is used by helm and gomplate.
+func FuncMap() template.FuncMap {
+	return template.FuncMap{
+		// strings
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, l []string) string { return strings.Join(l, sep) },
+		"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+		"squote":     func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" },
+		"indent":     indent,
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+
+		// defaults and checks
+		"default":  defaultValue,
+		"empty":    isEmpty,
+		"required": required,
+		"fail":     func(msg string) (string, error) { return "", errors.New(msg) },
+
+		// encoding
+		"toJson": toJSON,
+		"toYaml": toYAML,
+
+		// environment
+		"env":  os.Getenv,
+		"file": readFile,
+	}
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// defaultValue returns def if value is empty, e.g. {{ .Labels.env | default "prod" }}.
+func defaultValue(def, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func required(msg string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, errors.New(msg)
+	}
+	return value, nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+func toYAML(value interface{}) (string, error) {
+	b, err := yaml.Marshal(value)
+	return strings.TrimSuffix(string(b), "\n"), err
+}
+
+// readFile returns the content of a file, e.g. to include a shared snippet.
+func readFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	return string(b), err
+}
@@ -0,0 +1,119 @@
+package harvest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/template"
+
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// TemplateVersion is the version of the TemplateData model. It is increased
+// on incompatible changes of the model, so that templates can check it with
+// {{ if ne .Version 1 }}{{ fail "unsupported template version" }}{{ end }}.
+const TemplateVersion = 1
+
+// TemplateData is the data the harvest config templates are rendered with.
+//
+// Filer and Credentials are embedded, so that the templates written before
+// the data model was versioned can still refer to e.g. .Name and .Username.
+// New templates should use the qualified form, e.g. .Filer.Name and
+// .Credentials.Username.
+type TemplateData struct {
+	Version int
+
+	netbox.Filer
+	Credentials
+
+	// Region is the region the filer is discovered in.
+	Region string
+	// Pod is the worker pod rendering the template.
+	Pod Pod
+	// Cluster is the ONTAP cluster information of the filer. It is empty if
+	// the filer could not be queried.
+	Cluster netapp.Cluster
+	// Labels are custom labels, e.g. to add to the poller.
+	Labels map[string]string
+}
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type Pod struct {
+	Name      string
+	Namespace string
+}
+
+// Template is a parsed harvest config template.
+type Template struct {
+	*template.Template
+}
+
+// ParseTemplate parses the template files matching the pattern. Unknown
+// functions fail here, unknown fields fail in Validate.
+func ParseTemplate(pattern string) (*Template, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no template file matches %s", pattern)
+	}
+	tpl, err := template.New(filepath.Base(files[0])).
+		Funcs(FuncMap()).
+		Option("missingkey=error").
+		ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tpl}, nil
+}
+
+// ParseTemplateText parses a template from text, e.g. from a ConfigMap.
+func ParseTemplateText(name, text string) (*Template, error) {
+	tpl, err := template.New(name).
+		Funcs(FuncMap()).
+		Option("missingkey=error").
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tpl}, nil
+}
+
+// Validate renders the template with data, which does not need to have the
+// filer set yet; a placeholder filer is used then. It fails if the template
+// refers to fields that do not exist in the data model or to labels that are
+// not set, so that broken templates are detected before a filer is assigned.
+func (t *Template) Validate(data TemplateData) error {
+	data.Version = TemplateVersion
+	if data.Filer.Name == "" {
+		data.Filer = netbox.Filer{
+			Name:             "validate",
+			Host:             "validate.example.com",
+			AvailabilityZone: "validate",
+			Ip:               "127.0.0.1",
+			Status:           "active",
+		}
+	}
+	if err := t.Execute(io.Discard, data); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	return nil
+}
+
+// Render renders the template with the data into a buffer. The buffer is only
+// returned if rendering succeeds, so that no partial output is ever written.
+func (t *Template) Render(data TemplateData) ([]byte, error) {
+	data.Version = TemplateVersion
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
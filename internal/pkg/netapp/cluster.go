@@ -0,0 +1,36 @@
+package netapp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Cluster is the ONTAP cluster information returned by /api/cluster.
+type Cluster struct {
+	Name    string `json:"name" yaml:"name"`
+	UUID    string `json:"uuid" yaml:"uuid"`
+	Version struct {
+		Full       string `json:"full" yaml:"full"`
+		Generation int    `json:"generation" yaml:"generation"`
+		Major      int    `json:"major" yaml:"major"`
+		Minor      int    `json:"minor" yaml:"minor"`
+	} `json:"version" yaml:"version"`
+}
+
+func (f *FilerClient) GetCluster(ctx context.Context) (*Cluster, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := f.Get(ctx, "/api/cluster?fields=name,uuid,version")
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cluster := new(Cluster)
+	if err := json.NewDecoder(resp.Body).Decode(cluster); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
@@ -11,23 +11,60 @@ type Filer struct {
 	AvailabilityZone string `json:"availability_zone" yaml:"availability_zone"`
 	Ip               string `json:"ip,omitempty" yaml:"ip,omitempty"`
 	Status           string `json:"status,omitempty" yaml:"status,omitempty"`
+	// Tags are the slugs of the netbox tags of the filer.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// CustomFields are the netbox custom fields of the filer that are set.
+	CustomFields map[string]string `json:"custom_fields,omitempty" yaml:"custom_fields,omitempty"`
 }
 
-func (c Client) GetFilers(ctx context.Context, region, query string) (filers []Filer, err error) {
+// HasTag returns true if the filer has the netbox tag with the slug.
+func (f Filer) HasTag(slug string) bool {
+	for _, t := range f.Tags {
+		if t == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Client) GetFilers(ctx context.Context, region, query string) ([]Filer, error) {
+	tag, err := filerTag(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.getNetAppFilers(ctx, region, tag)
+}
+
+// GetFiler returns the filer with the name, or nil if there is no such filer
+// in the region with the tag.
+func (c Client) GetFiler(ctx context.Context, region, query, name string) (*Filer, error) {
+	tag, err := filerTag(query)
+	if err != nil {
+		return nil, err
+	}
+	filers, err := c.getNetAppFilers(ctx, region, tag, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filers {
+		if f.Name == name {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+// filerTag returns the netbox tag of the filer type.
+func filerTag(query string) (string, error) {
 	switch query {
 	case "md", "manila":
-		filers, err = c.getNetAppFilers(ctx, region, "manila")
+		return "manila", nil
 	case "bb", "cinder":
-		filers, err = c.getNetAppFilers(ctx, region, "cinder")
+		return "cinder", nil
 	case "bm", "baremetal":
-		filers, err = c.getNetAppFilers(ctx, region, "baremetal")
+		return "baremetal", nil
 	case "apod", "cp", "control-plane", "control_plane":
-		filers, err = c.getNetAppFilers(ctx, region, "apod")
-	default:
-		err = fmt.Errorf("%s is not valide filer type", query)
-	}
-	if err != nil {
-		return nil, err
+		return "apod", nil
 	}
-	return filers, nil
+	return "", fmt.Errorf("%s is not valide filer type", query)
 }
@@ -0,0 +1,23 @@
+package netbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	netboxRequestRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netappsd_netbox_request_retries_total",
+		Help: "Number of retried netbox requests.",
+	}, []string{"reason"})
+
+	netboxRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "netappsd_netbox_request_duration_seconds",
+		Help:    "Latency of netbox requests, one observation per attempt.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(netboxRequestRetries)
+	prometheus.MustRegister(netboxRequestDuration)
+}
@@ -3,7 +3,9 @@ package netbox
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/netbox-community/go-netbox/v4"
 )
@@ -12,18 +14,84 @@ type Client struct {
 	*netbox.APIClient
 }
 
-func NewClient(host, token string) (Client, error) {
+// NoRetries as ClientOptions.MaxRetries disables retries, since 0 means the
+// default.
+const NoRetries = -1
+
+type ClientOptions struct {
+	// MaxRetries is the number of retries of idempotent requests on
+	// transient failures; 0 means the default of 5 and NoRetries disables
+	// retries.
+	MaxRetries int
+	// RetryDelay is the initial backoff delay, which doubles on every retry.
+	RetryDelay time.Duration
+	// MaxRetryDelay caps the backoff delay.
+	MaxRetryDelay time.Duration
+	// RequestTimeout is the timeout of a single request attempt.
+	RequestTimeout time.Duration
+	// RateLimit is the number of requests per second sent to netbox.
+	RateLimit float64
+	// RateBurst is the number of requests allowed to exceed RateLimit.
+	RateBurst int
+}
+
+// NewClient returns a netbox client for the host, which defaults to https if
+// it has no scheme.
+func NewClient(host, token string, options *ClientOptions) (Client, error) {
+	options = mergeOptions(options)
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "https://" + host
+	}
 	c := netbox.NewAPIClientFor(host, token)
+	c.GetConfig().HTTPClient = &http.Client{
+		Transport: newRetryTransport(http.DefaultTransport, options),
+	}
 	return Client{c}, nil
 }
 
-func (c Client) getNetAppFilers(ctx context.Context, region, tag string) ([]Filer, error) {
-	filers, err := c.getFilers(ctx, region, tag)
+func mergeOptions(opts *ClientOptions) *ClientOptions {
+	defaultOpts := &ClientOptions{
+		MaxRetries:     5,
+		RetryDelay:     time.Second,
+		MaxRetryDelay:  30 * time.Second,
+		RequestTimeout: 60 * time.Second,
+		RateLimit:      10,
+		RateBurst:      10,
+	}
+	if opts != nil {
+		if opts.MaxRetries > 0 {
+			defaultOpts.MaxRetries = opts.MaxRetries
+		} else if opts.MaxRetries < 0 {
+			defaultOpts.MaxRetries = 0
+		}
+		if opts.RetryDelay > 0 {
+			defaultOpts.RetryDelay = opts.RetryDelay
+		}
+		if opts.MaxRetryDelay > 0 {
+			defaultOpts.MaxRetryDelay = opts.MaxRetryDelay
+		}
+		if opts.RequestTimeout > 0 {
+			defaultOpts.RequestTimeout = opts.RequestTimeout
+		}
+		if opts.RateLimit > 0 {
+			defaultOpts.RateLimit = opts.RateLimit
+		}
+		if opts.RateBurst > 0 {
+			defaultOpts.RateBurst = opts.RateBurst
+		}
+	}
+	return defaultOpts
+}
+
+// getNetAppFilers returns the filers in the region with the tag. If names are
+// given, only the filers with these names are returned.
+func (c Client) getNetAppFilers(ctx context.Context, region, tag string, names ...string) ([]Filer, error) {
+	filers, err := c.getFilers(ctx, region, tag, names...)
 	if err != nil {
 		return nil, err
 	}
 	if tag == "manila" {
-		clusters, err := c.getManilaFilerClusters(ctx, region)
+		clusters, err := c.getManilaFilerClusters(ctx, region, names...)
 		if err != nil {
 			return nil, err
 		}
@@ -38,31 +106,22 @@ func (c Client) getNetAppFilers(ctx context.Context, region, tag string) ([]File
 // from the first node of the filer.
 //
 // EG https://netbox.global.cloud.sap/dcim/devices/?region_id=19&role_id=13&manufacturer_id=11&tenant_id=1&interfaces=False
-func (c Client) getFilers(ctx context.Context, region, tag string) ([]Filer, error) {
+func (c Client) getFilers(ctx context.Context, region, tag string, names ...string) ([]Filer, error) {
 	netappFilers := make([]Filer, 0)
-	devices := make([]netbox.DeviceWithConfigContext, 0)
 
-	var limit int32 = 100
-	var offset int32 = 0
-	for {
-		d, _, err := c.DcimAPI.
-			DcimDevicesList(ctx).
-			Role([]string{"filer"}).
-			Manufacturer([]string{"netapp"}).
-			Region([]string{region}).
-			Tag([]string{tag}).
-			Interfaces(false).
-			Limit(limit).
-			Offset(offset).
-			Execute()
-		if err != nil {
-			return nil, err
-		}
-		devices = append(devices, d.Results...)
-		if d.GetNext() == "" {
-			break
-		}
-		offset += limit
+	req := c.DcimAPI.
+		DcimDevicesList(ctx).
+		Role([]string{"filer"}).
+		Manufacturer([]string{"netapp"}).
+		Region([]string{region}).
+		Tag([]string{tag}).
+		Interfaces(false)
+	if len(names) > 0 {
+		req = req.Name(names)
+	}
+	devices, err := c.listDevices(req)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, device := range devices {
@@ -84,13 +143,12 @@ func (c Client) getFilers(ctx context.Context, region, tag string) ([]Filer, err
 		}
 
 		// Primary ip address is not set on the filer, but on the first node
-		bays, _, err := c.DcimAPI.DcimDeviceBaysList(ctx).
-			DeviceId([]int32{device.Id}).
-			Execute()
+		bays, err := c.listDeviceBays(c.DcimAPI.DcimDeviceBaysList(ctx).
+			DeviceId([]int32{device.Id}))
 		if err != nil {
 			return nil, err
 		}
-		for _, deviceBay := range bays.Results {
+		for _, deviceBay := range bays {
 			if deviceBay.InstalledDevice.IsSet() {
 				installedDevice, _, err := c.DcimAPI.DcimDevicesRetrieve(ctx, deviceBay.InstalledDevice.Get().Id).Execute()
 				if err != nil {
@@ -111,6 +169,8 @@ func (c Client) getFilers(ctx context.Context, region, tag string) ([]Filer, err
 			Ip:               strings.Split(deviceIp, "/")[0],
 			Status:           deviceStatus,
 			AvailabilityZone: deviceAZ,
+			Tags:             tagSlugs(device.Tags),
+			CustomFields:     customFields(device.CustomFields),
 		})
 	}
 
@@ -121,45 +181,47 @@ func (c Client) getFilers(ctx context.Context, region, tag string) ([]Filer, err
 // Virtualization Cluster with "manila" tag in Netbox.
 //
 // EG https://netbox.global.cloud.sap/virtualization/clusters/?tag=manila&type_id=25
-func (c Client) getManilaFilerClusters(ctx context.Context, region string) ([]Filer, error) {
+func (c Client) getManilaFilerClusters(ctx context.Context, region string, names ...string) ([]Filer, error) {
 	filers := make([]Filer, 0)
 
-	clusters, _, err := c.VirtualizationAPI.
+	req := c.VirtualizationAPI.
 		VirtualizationClustersList(ctx).
 		Region([]string{region}).
 		// TypeN([]string{"NetApp Storage Cluster"}).
-		Tag([]string{"manila"}).
-		Execute()
+		Tag([]string{"manila"})
+	if len(names) > 0 {
+		req = req.Name(names)
+	}
+	clusters, err := c.listClusters(req)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, cluster := range clusters.Results {
+	for _, cluster := range clusters {
 		clusterId := cluster.Id
 		clusterName := cluster.Name
 		clusterIpAddr := ""
 		clusterStatus := ""
 		clusterSite := ""
 
-		res, _, err := c.
+		devices, err := c.listDevices(c.
 			DcimAPI.
 			DcimDevicesList(ctx).
 			ClusterId([]*int32{&clusterId}).
-			Role([]string{"filer"}).
-			Execute()
+			Role([]string{"filer"}))
 		if err != nil {
 			return nil, err
 		}
-		for i := range res.Results {
-			if res.Results[i].PrimaryIp4.IsSet() {
-				if addr, ok := res.Results[0].PrimaryIp4.Get().GetAddressOk(); ok {
+		for i := range devices {
+			if devices[i].PrimaryIp4.IsSet() {
+				if addr, ok := devices[i].PrimaryIp4.Get().GetAddressOk(); ok {
 					clusterIpAddr = *addr
 					break
 				}
 			}
 		}
-		for i := range res.Results {
-			if site, ok := res.Results[i].Site.GetNameOk(); ok {
+		for i := range devices {
+			if site, ok := devices[i].Site.GetNameOk(); ok {
 				clusterSite = strings.ToLower(*site)
 				break
 			}
@@ -176,7 +238,40 @@ func (c Client) getManilaFilerClusters(ctx context.Context, region string) ([]Fi
 			Ip:               strings.Split(clusterIpAddr, "/")[0],
 			Status:           clusterStatus,
 			AvailabilityZone: clusterSite,
+			Tags:             tagSlugs(cluster.Tags),
+			CustomFields:     customFields(cluster.CustomFields),
 		})
 	}
 	return filers, nil
 }
+
+func tagSlugs(tags []netbox.NestedTag) []string {
+	slugs := make([]string, 0, len(tags))
+	for _, t := range tags {
+		slugs = append(slugs, t.Slug)
+	}
+	return slugs
+}
+
+// customFields returns the custom fields that are set, formatted as strings.
+func customFields(fields map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if v != nil {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+func (c Client) listDevices(req netbox.ApiDcimDevicesListRequest) ([]netbox.DeviceWithConfigContext, error) {
+	return listAll[netbox.DeviceWithConfigContext, *netbox.PaginatedDeviceWithConfigContextList](req)
+}
+
+func (c Client) listDeviceBays(req netbox.ApiDcimDeviceBaysListRequest) ([]netbox.DeviceBay, error) {
+	return listAll[netbox.DeviceBay, *netbox.PaginatedDeviceBayList](req)
+}
+
+func (c Client) listClusters(req netbox.ApiVirtualizationClustersListRequest) ([]netbox.Cluster, error) {
+	return listAll[netbox.Cluster, *netbox.PaginatedClusterList](req)
+}
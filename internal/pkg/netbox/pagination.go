@@ -0,0 +1,43 @@
+package netbox
+
+import (
+	"net/http"
+)
+
+// pageSize is the number of objects requested from netbox per page.
+const pageSize int32 = 100
+
+// paginatedList is implemented by the Paginated*List models of go-netbox.
+type paginatedList[T any] interface {
+	GetResults() []T
+	GetNext() string
+}
+
+// listRequest is implemented by the Api*ListRequest builders of go-netbox.
+// R is the request type itself, since the builder methods return a copy.
+type listRequest[R any, P any] interface {
+	Limit(int32) R
+	Offset(int32) R
+	Execute() (P, *http.Response, error)
+}
+
+// listAll executes a netbox list request page by page and returns the results
+// of all pages. It stops when netbox does not return a link to the next page.
+//
+// EG devices, err := listAll[netbox.DeviceWithConfigContext, *netbox.PaginatedDeviceWithConfigContextList](req)
+func listAll[T any, P paginatedList[T], R listRequest[R, P]](req R) ([]T, error) {
+	results := make([]T, 0)
+	var offset int32 = 0
+	for {
+		page, _, err := req.Limit(pageSize).Offset(offset).Execute()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, page.GetResults()...)
+		if page.GetNext() == "" {
+			break
+		}
+		offset += pageSize
+	}
+	return results, nil
+}
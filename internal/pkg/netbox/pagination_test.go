@@ -0,0 +1,108 @@
+package netbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeClusters serves count clusters from /api/virtualization/clusters/ with
+// limit/offset pagination, like netbox, and records the requested offsets.
+func fakeClusters(t *testing.T, count int) (*httptest.Server, func() []int) {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		offsets []int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/virtualization/clusters/", func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		mu.Lock()
+		offsets = append(offsets, offset)
+		mu.Unlock()
+
+		results := make([]map[string]any, 0, limit)
+		for i := offset; i < count && i < offset+limit; i++ {
+			results = append(results, map[string]any{
+				"id":      i + 1,
+				"url":     fmt.Sprintf("http://%s/api/virtualization/clusters/%d/", r.Host, i+1),
+				"display": fmt.Sprintf("cluster-%d", i+1),
+				"name":    fmt.Sprintf("cluster-%d", i+1),
+				"type": map[string]any{
+					"id": 1, "url": "http://netbox/api/virtualization/cluster-types/1/",
+					"display": "NetApp", "name": "NetApp", "slug": "netapp",
+				},
+			})
+		}
+		var next any
+		if offset+limit < count {
+			next = fmt.Sprintf("http://%s%s?limit=%d&offset=%d", r.Host, r.URL.Path, limit, offset+limit)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":    count,
+			"next":     next,
+			"previous": nil,
+			"results":  results,
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), offsets...)
+	}
+}
+
+func TestListAllFetchesEveryPage(t *testing.T) {
+	const count = 250
+	server, offsets := fakeClusters(t, count)
+	c, err := NewClient(server.URL, "token", &ClientOptions{RateLimit: 1000, RateBurst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := c.listClusters(c.VirtualizationAPI.VirtualizationClustersList(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != count {
+		t.Fatalf("got %d clusters, want %d", len(clusters), count)
+	}
+	for i, cluster := range clusters {
+		if want := fmt.Sprintf("cluster-%d", i+1); cluster.Name != want {
+			t.Fatalf("cluster %d is %s, want %s", i, cluster.Name, want)
+		}
+	}
+	got := offsets()
+	want := []int{0, 100, 200}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("requested offsets %v, want %v", got, want)
+	}
+}
+
+func TestListAllSinglePage(t *testing.T) {
+	server, offsets := fakeClusters(t, int(pageSize))
+	c, err := NewClient(server.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := c.listClusters(c.VirtualizationAPI.VirtualizationClustersList(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != int(pageSize) {
+		t.Fatalf("got %d clusters, want %d", len(clusters), pageSize)
+	}
+	if got := offsets(); len(got) != 1 {
+		t.Fatalf("requested offsets %v, want a single page", got)
+	}
+}
@@ -0,0 +1,140 @@
+package netbox
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// retryTransport is a http.RoundTripper that rate limits all requests to
+// netbox and retries idempotent requests on transient failures. Transient
+// failures are network errors, timeouts, 5xx responses and 429 responses.
+type retryTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+	options *ClientOptions
+}
+
+func newRetryTransport(next http.RoundTripper, options *ClientOptions) *retryTransport {
+	return &retryTransport{
+		next:    next,
+		limiter: rate.NewLimiter(rate.Limit(options.RateLimit), options.RateBurst),
+		options: options,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.roundTripOnce(req)
+
+		if !isIdempotent(req.Method) || attempt >= t.options.MaxRetries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		reason := "error"
+		if resp != nil {
+			reason = strconv.Itoa(resp.StatusCode)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				// honor Retry-After, but do not wait longer than a backoff
+				if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					delay = min(retryAfter, t.options.MaxRetryDelay)
+				}
+			}
+			// drain the body, so that the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		netboxRequestRetries.WithLabelValues(reason).Inc()
+		slog.Warn("retry netbox request", "url", req.URL.Path, "attempt", attempt+1, "reason", reason, "delay", delay, "error", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// roundTripOnce sends the request with a per attempt timeout. The timeout
+// stays active until the response body is closed.
+func (t *retryTransport) roundTripOnce(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.options.RequestTimeout)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req.Clone(ctx))
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	netboxRequestDuration.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff returns the exponential backoff delay with full jitter for the
+// given attempt, capped at MaxRetryDelay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.options.RetryDelay << attempt
+	if d <= 0 || d > t.options.MaxRetryDelay {
+		d = t.options.MaxRetryDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of
+// seconds or a HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,137 @@
+package netbox
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNetbox replies to the requests with the status codes in order, and with
+// the last one to any further request. It returns the number of requests.
+func fakeNetbox(t *testing.T, header http.Header, codes ...int) (*httptest.Server, func() int) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(requests.Add(1)) - 1
+		code := codes[min(i, len(codes)-1)]
+		if code != http.StatusOK {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int { return int(requests.Load()) }
+}
+
+func newTestClient(options *ClientOptions) *http.Client {
+	options.RateLimit = 1000
+	options.RateBurst = 1000
+	return &http.Client{Transport: newRetryTransport(http.DefaultTransport, mergeOptions(options))}
+}
+
+func do(t *testing.T, ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestRetryAfterCappedAtMaxRetryDelay(t *testing.T) {
+	server, requests := fakeNetbox(t, http.Header{"Retry-After": {"60"}}, http.StatusTooManyRequests, http.StatusOK)
+	client := newTestClient(&ClientOptions{MaxRetryDelay: 50 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := do(t, context.Background(), client, http.MethodGet, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := requests(); got != 2 {
+		t.Fatalf("%d requests, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("retried after %s, want the max retry delay of 50ms", elapsed)
+	}
+}
+
+func TestRetryServerErrorRecovers(t *testing.T) {
+	server, requests := fakeNetbox(t, nil, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK)
+	client := newTestClient(&ClientOptions{RetryDelay: time.Millisecond})
+
+	resp, err := do(t, context.Background(), client, http.MethodGet, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := requests(); got != 3 {
+		t.Fatalf("%d requests, want 3", got)
+	}
+}
+
+func TestPostNotRetried(t *testing.T) {
+	server, requests := fakeNetbox(t, nil, http.StatusServiceUnavailable, http.StatusOK)
+	client := newTestClient(&ClientOptions{RetryDelay: time.Millisecond})
+
+	resp, err := do(t, context.Background(), client, http.MethodPost, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := requests(); got != 1 {
+		t.Fatalf("%d requests, want 1", got)
+	}
+}
+
+func TestNoRetries(t *testing.T) {
+	server, requests := fakeNetbox(t, nil, http.StatusServiceUnavailable, http.StatusOK)
+	client := newTestClient(&ClientOptions{MaxRetries: NoRetries, RetryDelay: time.Millisecond})
+
+	resp, err := do(t, context.Background(), client, http.MethodGet, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := requests(); got != 1 {
+		t.Fatalf("%d requests, want 1", got)
+	}
+}
+
+func TestContextCanceledDuringBackoff(t *testing.T) {
+	// Retry-After makes the backoff deterministic
+	server, requests := fakeNetbox(t, http.Header{"Retry-After": {"10"}}, http.StatusTooManyRequests)
+	client := newTestClient(&ClientOptions{MaxRetryDelay: 10 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := do(t, ctx, client, http.MethodGet, server.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("returned after %s, want right after the cancellation", elapsed)
+	}
+	if got := requests(); got != 1 {
+		t.Fatalf("%d requests, want 1", got)
+	}
+}
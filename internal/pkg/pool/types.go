@@ -0,0 +1,166 @@
+// Package pool defines the NetAppExporterPool custom resource, which
+// configures a master in controller mode.
+package pool
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "netappsd.cloud.sap"
+	Version = "v1alpha1"
+	Kind    = "NetAppExporterPool"
+)
+
+// Resource is the resource of the NetAppExporterPool custom resource.
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "netappexporterpools"}
+
+// Condition types of the pool status.
+const (
+	// ConditionReady is true once the pool's master has discovered the
+	// filers.
+	ConditionReady = "Ready"
+	// ConditionNetboxReachable is false while netbox is unreachable and the
+	// filers are probed from the last known inventory.
+	ConditionNetboxReachable = "NetboxReachable"
+	// ConditionTemplateValid is false if the worker template does not
+	// render.
+	ConditionTemplateValid = "TemplateValid"
+)
+
+// NetAppExporterPool is a pool of workers that export the filers discovered
+// in netbox.
+type NetAppExporterPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+type Spec struct {
+	// Netbox is the filter of the filers in netbox.
+	Netbox NetboxFilter `json:"netbox"`
+	// Worker is the worker deployment of the pool.
+	Worker Worker `json:"worker"`
+	// Template is the harvest config template of the workers. It is
+	// validated by the controller.
+	Template *Template `json:"template,omitempty"`
+	// Scaling is the scaling policy of the worker deployment.
+	Scaling Scaling `json:"scaling,omitempty"`
+	// Queue is the order in which filers are assigned to workers.
+	Queue Queue `json:"queue,omitempty"`
+	// Rebalance moves filers to workers in their availability zone.
+	Rebalance Rebalance `json:"rebalance,omitempty"`
+}
+
+type NetboxFilter struct {
+	Region string `json:"region"`
+	Tag    string `json:"tag"`
+}
+
+type Worker struct {
+	// Deployment is the name of the worker deployment.
+	Deployment string `json:"deployment"`
+	// Label selects the worker pods; it defaults to name=<deployment>.
+	Label string `json:"label,omitempty"`
+	// Port is the port workers listen on; it defaults to 8082.
+	Port int `json:"port,omitempty"`
+	// Mode is "shared" or "per-filer"; it defaults to "shared".
+	Mode string `json:"mode,omitempty"`
+}
+
+type Template struct {
+	// ConfigMap is the name of the ConfigMap with the template.
+	ConfigMap string `json:"configMap"`
+	// Key is the key of the template in the ConfigMap.
+	Key string `json:"key"`
+	// Labels are the labels the template is rendered with.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Render lets the master render the config of every filer into a
+	// secret, which replaces the volume Volume of the per-filer
+	// deployments. It requires the per-filer worker mode.
+	Render bool `json:"render,omitempty"`
+	// Volume is the volume replaced by the rendered config; it defaults to
+	// "shared".
+	Volume string `json:"volume,omitempty"`
+}
+
+type Scaling struct {
+	// MinReplicas and MaxReplicas limit the replicas of the worker
+	// deployment; 0 means no limit.
+	MinReplicas int32 `json:"minReplicas,omitempty"`
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+	// MaxScaleUp and MaxScaleDown limit the replicas added or removed in one
+	// update; 0 means no limit.
+	MaxScaleUp   int32 `json:"maxScaleUp,omitempty"`
+	MaxScaleDown int32 `json:"maxScaleDown,omitempty"`
+	// ScaleUpCooldown is the time after a scale up before the next scale up.
+	// ScaleDownCooldown is the time after any scaling before a scale down.
+	ScaleUpCooldown   metav1.Duration `json:"scaleUpCooldown,omitempty"`
+	ScaleDownCooldown metav1.Duration `json:"scaleDownCooldown,omitempty"`
+	// Retire is "deletion-cost" or "evict"; it defaults to "deletion-cost".
+	Retire string `json:"retire,omitempty"`
+}
+
+type Queue struct {
+	// PriorityTags are netbox tags in order of priority.
+	PriorityTags []string `json:"priorityTags,omitempty"`
+	// PriorityField is a netbox custom field with a numeric priority.
+	PriorityField string `json:"priorityField,omitempty"`
+	// LabTag is the netbox tag of lab filers, which come after production
+	// filers.
+	LabTag string `json:"labTag,omitempty"`
+	// AZFairness lets the availability zones take turns.
+	AZFairness bool `json:"azFairness,omitempty"`
+}
+
+type Rebalance struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval is the minimum time between two moves; it defaults to 10m.
+	Interval metav1.Duration `json:"interval,omitempty"`
+}
+
+type Status struct {
+	// ObservedGeneration is the generation of the spec the master runs
+	// with.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Filers are the discovered filers and their workers.
+	Filers []FilerStatus `json:"filers,omitempty"`
+	// Queue are the filers waiting for a worker.
+	Queue []string `json:"queue,omitempty"`
+	// Unassigned are the discovered filers without a worker.
+	Unassigned []string `json:"unassigned,omitempty"`
+	// Conditions are Ready, NetboxReachable and TemplateValid.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+type FilerStatus struct {
+	Name             string `json:"name"`
+	Host             string `json:"host"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	Worker           string `json:"worker,omitempty"`
+}
+
+// FromUnstructured converts an object returned by the dynamic client.
+func FromUnstructured(u *unstructured.Unstructured) (*NetAppExporterPool, error) {
+	p := new(NetAppExporterPool)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, p); err != nil {
+		return nil, fmt.Errorf("invalid %s %s/%s: %w", Kind, u.GetNamespace(), u.GetName(), err)
+	}
+	return p, nil
+}
+
+// ToUnstructured converts the pool for the dynamic client.
+func (p *NetAppExporterPool) ToUnstructured() (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
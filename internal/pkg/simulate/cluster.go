@@ -0,0 +1,300 @@
+package simulate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const deletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+
+// cluster is a fake Kubernetes cluster with the worker deployment, a node
+// per zone and a simulated deployment controller, which creates and deletes
+// worker pods to match the replicas of the deployment.
+type cluster struct {
+	clientset     *fake.Clientset
+	namespace     string
+	worker        string
+	zones         []string
+	podStartSteps int
+
+	mu          sync.Mutex
+	downZones   map[string]bool
+	createdAt   map[string]int
+	nextPod     int
+	podsCreated int
+	podsDeleted int
+}
+
+func newCluster(namespace, worker string, zones []string, podStartSteps int) *cluster {
+	replicas := int32(0)
+	labels := map[string]string{"name": worker}
+	objects := []runtime.Object{&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: worker, Namespace: namespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "worker", Image: "netappsd"}}},
+			},
+		},
+	}}
+	for _, zone := range zones {
+		objects = append(objects, &v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   nodeName(zone),
+			Labels: map[string]string{v1.LabelTopologyZone: zone},
+		}})
+	}
+	c := &cluster{
+		clientset:     fake.NewSimpleClientset(objects...),
+		namespace:     namespace,
+		worker:        worker,
+		zones:         zones,
+		podStartSteps: podStartSteps,
+		downZones:     make(map[string]bool),
+		createdAt:     make(map[string]int),
+	}
+	c.clientset.PrependReactor("create", "pods", c.evict)
+	return c
+}
+
+func nodeName(zone string) string {
+	return "node-" + zone
+}
+
+// evict deletes the pod of an eviction, which the fake clientset does not.
+// There are no PodDisruptionBudgets in the simulation.
+func (c *cluster) evict(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "eviction" {
+		return false, nil, nil
+	}
+	eviction, ok := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+	if !ok {
+		return false, nil, nil
+	}
+	err := c.clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), c.namespace, eviction.Name)
+	if err == nil {
+		c.mu.Lock()
+		c.podsDeleted++
+		c.mu.Unlock()
+	}
+	return true, nil, err
+}
+
+func (c *cluster) listPods(ctx context.Context) ([]v1.Pod, error) {
+	pods, err := c.clientset.CoreV1().Pods(c.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "name=" + c.worker,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// replicas returns the replicas of the worker deployment.
+func (c *cluster) replicas(ctx context.Context) (int32, error) {
+	d, err := c.clientset.AppsV1().Deployments(c.namespace).Get(ctx, c.worker, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return *d.Spec.Replicas, nil
+}
+
+// setReplicas sets the replicas of the worker deployment, like an
+// autoscaler.
+func (c *cluster) setReplicas(ctx context.Context, replicas int32) error {
+	d, err := c.clientset.AppsV1().Deployments(c.namespace).Get(ctx, c.worker, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if *d.Spec.Replicas == replicas {
+		return nil
+	}
+	d.Spec.Replicas = &replicas
+	_, err = c.clientset.AppsV1().Deployments(c.namespace).Update(ctx, d, metav1.UpdateOptions{})
+	return err
+}
+
+// reconcile creates and deletes worker pods to match the replicas, like the
+// deployment controller. New pods are scheduled to the zone with the fewest
+// pods. Pods are deleted in the order of the ReplicaSet controller: pods
+// that are not started yet first, then by pod deletion cost, then the
+// newest.
+func (c *cluster) reconcile(ctx context.Context, step int) error {
+	replicas, err := c.replicas(ctx)
+	if err != nil {
+		return err
+	}
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(pods); i < int(replicas); i++ {
+		zone := c.scheduleZone(pods)
+		if zone == "" {
+			break
+		}
+		c.nextPod++
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%05d", c.worker, c.nextPod),
+				Namespace: c.namespace,
+				Labels:    map[string]string{"name": c.worker},
+			},
+			Spec:   v1.PodSpec{NodeName: nodeName(zone)},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		}
+		if _, err := c.clientset.CoreV1().Pods(c.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		pods = append(pods, *pod)
+		c.createdAt[pod.Name] = step
+		c.podsCreated++
+	}
+
+	if excess := len(pods) - int(replicas); excess > 0 {
+		sort.SliceStable(pods, func(i, j int) bool {
+			si, sj := c.started(pods[i].Name, step), c.started(pods[j].Name, step)
+			if si != sj {
+				return !si
+			}
+			ci, cj := deletionCost(pods[i]), deletionCost(pods[j])
+			if ci != cj {
+				return ci < cj
+			}
+			return c.createdAt[pods[i].Name] > c.createdAt[pods[j].Name]
+		})
+		for _, pod := range pods[:excess] {
+			if err := c.deletePod(ctx, pod.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scheduleZone returns the zone with the fewest pods that is not down, or
+// an empty string if all zones are down. It must be called with c.mu held.
+func (c *cluster) scheduleZone(pods []v1.Pod) string {
+	count := make(map[string]int)
+	for _, pod := range pods {
+		count[pod.Spec.NodeName]++
+	}
+	zone := ""
+	for _, z := range c.zones {
+		if c.downZones[z] {
+			continue
+		}
+		if zone == "" || count[nodeName(z)] < count[nodeName(zone)] {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// started returns true if the worker in the pod is started. It must be
+// called with c.mu held.
+func (c *cluster) started(podName string, step int) bool {
+	createdAt, found := c.createdAt[podName]
+	return found && step-createdAt >= c.podStartSteps
+}
+
+// deletePod must be called with c.mu held.
+func (c *cluster) deletePod(ctx context.Context, podName string) error {
+	err := c.clientset.CoreV1().Pods(c.namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil {
+		return err
+	}
+	delete(c.createdAt, podName)
+	c.podsDeleted++
+	return nil
+}
+
+func deletionCost(pod v1.Pod) int {
+	cost, _ := strconv.Atoi(pod.Annotations[deletionCostAnnotation])
+	return cost
+}
+
+// wipeLabels removes the filer label from all worker pods.
+func (c *cluster) wipeLabels(ctx context.Context) error {
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if _, found := pod.Labels["filer"]; !found {
+			continue
+		}
+		delete(pod.Labels, "filer")
+		if _, err := c.clientset.CoreV1().Pods(c.namespace).Update(ctx, &pod, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// killPods deletes count worker pods with a filer.
+func (c *cluster) killPods(ctx context.Context, count int) error {
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pod := range pods {
+		if count == 0 {
+			break
+		}
+		if _, found := pod.Labels["filer"]; found {
+			if err := c.deletePod(ctx, pod.Name); err != nil {
+				return err
+			}
+			count--
+		}
+	}
+	return nil
+}
+
+// setZoneDown deletes the worker pods in the zone, if it goes down, and
+// stops or resumes scheduling pods there.
+func (c *cluster) setZoneDown(ctx context.Context, zone string, down bool) error {
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.downZones[zone] = down
+	if !down {
+		return nil
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName == nodeName(zone) {
+			if err := c.deletePod(ctx, pod.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// churn returns the number of pods created and deleted so far.
+func (c *cluster) churn() (created, deleted int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.podsCreated, c.podsDeleted
+}
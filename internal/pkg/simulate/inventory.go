@@ -0,0 +1,157 @@
+package simulate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/sapcc/netappsd/internal/pkg/netapp"
+	"github.com/sapcc/netappsd/internal/pkg/netbox"
+)
+
+// inventory is the scripted netbox. It implements netappsd.FilerSource.
+type inventory struct {
+	mu     sync.Mutex
+	filers []netbox.Filer
+	down   bool
+	added  int
+}
+
+func (i *inventory) GetFilers(_ context.Context, _, _ string) ([]netbox.Filer, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.down {
+		return nil, errors.New("netbox is down")
+	}
+	return append([]netbox.Filer{}, i.filers...), nil
+}
+
+func (i *inventory) GetFiler(ctx context.Context, region, tag, name string) (*netbox.Filer, error) {
+	filers, err := i.GetFilers(ctx, region, tag)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filers {
+		if f.Name == name {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+// add adds count filers in the zone, or spread over the zones.
+func (i *inventory) add(count int, zone string, zones []string, tags []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for j := 0; j < count; j++ {
+		i.added++
+		az := zone
+		if az == "" {
+			az = zones[i.added%len(zones)]
+		}
+		name := fmt.Sprintf("filer-%04d", i.added)
+		i.filers = append(i.filers, netbox.Filer{
+			Name:             name,
+			Host:             name + ".sim",
+			Ip:               fmt.Sprintf("10.%d.%d.%d", i.added>>16&255, i.added>>8&255, i.added&255),
+			AvailabilityZone: az,
+			Status:           "active",
+			Tags:             tags,
+		})
+	}
+}
+
+// remove removes the oldest filers.
+func (i *inventory) remove(count int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.filers = i.filers[min(count, len(i.filers)):]
+}
+
+// deactivate sets the status of the oldest active filers to offline.
+func (i *inventory) deactivate(count int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for j := range i.filers {
+		if count == 0 {
+			return
+		}
+		if i.filers[j].Status == "active" {
+			i.filers[j].Status = "offline"
+			count--
+		}
+	}
+}
+
+func (i *inventory) setDown(down bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.down = down
+}
+
+// active returns the names of the active filers.
+func (i *inventory) active() map[string]struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	filers := make(map[string]struct{})
+	for _, f := range i.filers {
+		if f.Status == "active" {
+			filers[f.Name] = struct{}{}
+		}
+	}
+	return filers
+}
+
+// expected returns the active filers the ONTAP stub can probe, which the
+// master is expected to assign to workers.
+func (i *inventory) expected(o *ontap) map[string]netbox.Filer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	filers := make(map[string]netbox.Filer)
+	for _, f := range i.filers {
+		if f.Status == "active" && !o.fails(f.Name) {
+			filers[f.Name] = f
+		}
+	}
+	return filers
+}
+
+// ontap is the stub of the ONTAP API. It fails to probe a stable share of
+// the filers, chosen by the hash of the filer name. It implements
+// netappsd.Ontap.
+type ontap struct {
+	mu          sync.Mutex
+	failureRate float64
+}
+
+func (o *ontap) setFailureRate(rate float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failureRate = rate
+}
+
+func (o *ontap) fails(filerName string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h := fnv.New32a()
+	h.Write([]byte(filerName))
+	return float64(h.Sum32()%1000) < o.failureRate*1000
+}
+
+func (o *ontap) Probe(_ context.Context, filer netbox.Filer) error {
+	if o.fails(filer.Name) {
+		return fmt.Errorf("connect to %s: connection refused", filer.Ip)
+	}
+	return nil
+}
+
+func (o *ontap) GetCluster(ctx context.Context, filer netbox.Filer) (*netapp.Cluster, error) {
+	if err := o.Probe(ctx, filer); err != nil {
+		return nil, err
+	}
+	c := &netapp.Cluster{Name: filer.Name, UUID: filer.Name}
+	c.Version.Full = "NetApp Release 9.13.1"
+	return c, nil
+}
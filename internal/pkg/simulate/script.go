@@ -0,0 +1,94 @@
+package simulate
+
+import (
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/sapcc/netappsd/internal/pkg/pool"
+)
+
+// Script is the timeline of a simulation.
+type Script struct {
+	// Master is the policy of the simulated master.
+	Master Master `json:"master"`
+	// Step is the wall time of a step. The master updates the workers once
+	// per step.
+	Step metav1.Duration `json:"step"`
+	// Steps is the number of steps to simulate.
+	Steps int `json:"steps"`
+	// DiscoverySteps is the number of steps between two filer discoveries.
+	DiscoverySteps int `json:"discoverySteps"`
+	// PodStartSteps is the number of steps a new pod takes to run.
+	PodStartSteps int `json:"podStartSteps"`
+	// Zones are the availability zones of the nodes and the filers.
+	Zones []string `json:"zones"`
+	// Events change the inventory, the ONTAP stub or the cluster at a step.
+	Events []Event `json:"events"`
+}
+
+// Master is the policy of the simulated master, with the fields of the
+// NetAppExporterPool.
+type Master struct {
+	// Replicas is "master" or "external"; with "external" the simulated
+	// autoscaler sets the desired workers as replicas.
+	Replicas  string         `json:"replicas,omitempty"`
+	Scaling   pool.Scaling   `json:"scaling,omitempty"`
+	Queue     pool.Queue     `json:"queue,omitempty"`
+	Rebalance pool.Rebalance `json:"rebalance,omitempty"`
+}
+
+// Event is a change at a step of the simulation.
+type Event struct {
+	Step int `json:"step"`
+	// AddFilers adds filers to netbox, in Zone or spread over the zones,
+	// with Tags.
+	AddFilers int      `json:"addFilers,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// RemoveFilers removes the oldest filers from netbox.
+	RemoveFilers int `json:"removeFilers,omitempty"`
+	// DeactivateFilers sets the status of the oldest active filers to
+	// offline.
+	DeactivateFilers int `json:"deactivateFilers,omitempty"`
+	// ProbeFailureRate is the share of filers the ONTAP stub fails to probe
+	// from this step on, between 0 and 1.
+	ProbeFailureRate *float64 `json:"probeFailureRate,omitempty"`
+	// NetboxDown makes netbox unreachable, or reachable again.
+	NetboxDown *bool `json:"netboxDown,omitempty"`
+	// WipeLabels removes the filer label from all worker pods.
+	WipeLabels bool `json:"wipeLabels,omitempty"`
+	// KillPods deletes worker pods with a filer.
+	KillPods int `json:"killPods,omitempty"`
+	// ZoneDown deletes the worker pods in the zone and schedules no pods
+	// there, until ZoneUp.
+	ZoneDown string `json:"zoneDown,omitempty"`
+	ZoneUp   string `json:"zoneUp,omitempty"`
+}
+
+// LoadScript reads the script from a YAML file and sets the defaults.
+func LoadScript(path string) (*Script, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(Script)
+	if err := yaml.UnmarshalStrict(b, s); err != nil {
+		return nil, fmt.Errorf("invalid script %s: %w", path, err)
+	}
+	if s.Step.Duration <= 0 {
+		s.Step.Duration = defaultStep
+	}
+	if s.Steps <= 0 {
+		return nil, fmt.Errorf("invalid script %s: steps must be positive", path)
+	}
+	if s.DiscoverySteps <= 0 {
+		s.DiscoverySteps = 5
+	}
+	if len(s.Zones) == 0 {
+		s.Zones = []string{"a"}
+	}
+	return s, nil
+}
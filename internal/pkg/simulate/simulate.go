@@ -0,0 +1,334 @@
+// Package simulate runs a master against a fake Kubernetes cluster, a
+// scripted netbox and an ONTAP stub, to try scaling and queue policies
+// without touching a real cluster.
+package simulate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/netappsd/internal/netappsd"
+)
+
+const (
+	defaultStep = 200 * time.Millisecond
+	namespace   = "netapp-exporters"
+	workerName  = "netappsd-worker"
+)
+
+// StepStats is the state of the simulation at the end of a step.
+type StepStats struct {
+	Step int `json:"step"`
+	// Replicas are the replicas of the worker deployment.
+	Replicas int32 `json:"replicas"`
+	// Pods are the worker pods, Assigned the pods with a filer.
+	Pods     int `json:"pods"`
+	Assigned int `json:"assigned"`
+	// Desired and Queued are reported by the master.
+	Desired int `json:"desired"`
+	Queued  int `json:"queued"`
+	// Expected are the active filers that pass probing; Unassigned are the
+	// expected filers without a worker.
+	Expected   int `json:"expected"`
+	Unassigned int `json:"unassigned"`
+	// Stale are the workers of filers that are removed or not active.
+	Stale int `json:"stale"`
+	// PodsCreated, PodsDeleted and Assignments happened during the step.
+	PodsCreated int `json:"podsCreated"`
+	PodsDeleted int `json:"podsDeleted"`
+	Assignments int `json:"assignments"`
+	// Converged is true if every expected filer has a worker, there are no
+	// stale workers and no free workers beyond MinReplicas. Workers keep
+	// filers that fail probing, like the master does.
+	Converged bool `json:"converged"`
+}
+
+// Phase are the steps from an event until the next event.
+type Phase struct {
+	Step   int      `json:"step"`
+	Events []string `json:"events"`
+	// ConvergedAfter is the number of steps after the start of the phase
+	// from which on the simulation stayed converged, or -1 if it did not
+	// converge.
+	ConvergedAfter int `json:"convergedAfter"`
+	PodsCreated    int `json:"podsCreated"`
+	PodsDeleted    int `json:"podsDeleted"`
+	Assignments    int `json:"assignments"`
+	MaxUnassigned  int `json:"maxUnassigned"`
+	// UnassignedSteps is the sum of the unassigned filers of all steps.
+	UnassignedSteps int `json:"unassignedSteps"`
+}
+
+// Report is the result of a simulation.
+type Report struct {
+	Step   time.Duration `json:"step"`
+	Phases []Phase       `json:"phases"`
+	Steps  []StepStats   `json:"steps"`
+}
+
+// Run runs the script and reports convergence time, churn and unassigned
+// filers for every phase.
+func Run(ctx context.Context, s *Script) (*Report, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := newCluster(namespace, workerName, s.Zones, s.PodStartSteps)
+	inv := new(inventory)
+	o := new(ontap)
+	n := &netappsd.NetAppSD{
+		Namespace:          namespace,
+		Region:             "sim",
+		FilerTag:           "sim",
+		WorkerName:         workerName,
+		WorkerLabel:        "name=" + workerName,
+		WorkerPort:         8082,
+		OverridesConfigMap: workerName + "-overrides",
+		DiscoveryInterval:  s.Step.Duration * time.Duration(s.DiscoverySteps),
+		UpdateInterval:     s.Step.Duration,
+		Replicas:           s.Master.Replicas,
+		MinReplicas:        s.Master.Scaling.MinReplicas,
+		MaxReplicas:        s.Master.Scaling.MaxReplicas,
+		MaxScaleUp:         s.Master.Scaling.MaxScaleUp,
+		MaxScaleDown:       s.Master.Scaling.MaxScaleDown,
+		ScaleUpCooldown:    s.Master.Scaling.ScaleUpCooldown.Duration,
+		ScaleDownCooldown:  s.Master.Scaling.ScaleDownCooldown.Duration,
+		Retire:             s.Master.Scaling.Retire,
+		QueuePolicy:        netappsd.QueuePolicy(s.Master.Queue),
+		Rebalance:          s.Master.Rebalance.Enabled,
+		RebalanceInterval:  s.Master.Rebalance.Interval.Duration,
+	}
+	defer n.Wait()
+	defer cancel()
+
+	eventsAt := make(map[int][]Event)
+	for _, e := range s.Events {
+		eventsAt[e.Step] = append(eventsAt[e.Step], e)
+	}
+
+	report := &Report{Step: s.Step.Duration}
+	var phase *Phase
+	lastCreated, lastDeleted := 0, 0
+	tick := time.NewTicker(s.Step.Duration)
+	defer tick.Stop()
+
+	for step := 0; step < s.Steps; step++ {
+		events := eventsAt[step]
+		for _, e := range events {
+			if err := apply(ctx, e, s.Zones, c, inv, o); err != nil {
+				return nil, fmt.Errorf("event at step %d: %w", step, err)
+			}
+		}
+		if step == 0 {
+			// start the master with the inventory of the first step
+			opts := []netappsd.Option{
+				netappsd.WithKubeClient(c.clientset),
+				netappsd.WithFilerSource(inv),
+				netappsd.WithOntap(o),
+			}
+			if err := n.Run(ctx, opts...); err != nil {
+				return nil, err
+			}
+		} else if len(events) > 0 {
+			n.TriggerDiscovery("simulation")
+		}
+		if step == 0 || len(events) > 0 {
+			report.Phases = append(report.Phases, Phase{Step: step, Events: describe(events), ConvergedAfter: -1})
+			phase = &report.Phases[len(report.Phases)-1]
+		}
+
+		if n.Replicas == netappsd.ReplicasExternal {
+			// act as the autoscaler of the deployment
+			if err := c.setReplicas(ctx, int32(n.Scaling().Desired)); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.reconcile(ctx, step); err != nil {
+			return nil, err
+		}
+		assignments, err := runWorkers(ctx, c, n, step)
+		if err != nil {
+			return nil, err
+		}
+
+		stats, err := observe(ctx, c, n, inv, o)
+		if err != nil {
+			return nil, err
+		}
+		stats.Step = step
+		stats.Assignments = assignments
+		created, deleted := c.churn()
+		stats.PodsCreated, stats.PodsDeleted = created-lastCreated, deleted-lastDeleted
+		lastCreated, lastDeleted = created, deleted
+		report.Steps = append(report.Steps, stats)
+
+		phase.PodsCreated += stats.PodsCreated
+		phase.PodsDeleted += stats.PodsDeleted
+		phase.Assignments += stats.Assignments
+		phase.MaxUnassigned = max(phase.MaxUnassigned, stats.Unassigned)
+		phase.UnassignedSteps += stats.Unassigned
+		if !stats.Converged {
+			phase.ConvergedAfter = -1
+		} else if phase.ConvergedAfter < 0 {
+			phase.ConvergedAfter = step - phase.Step
+		}
+
+		// the fake clientset records every action
+		c.clientset.ClearActions()
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return report, nil
+}
+
+func apply(ctx context.Context, e Event, zones []string, c *cluster, inv *inventory, o *ontap) error {
+	if e.AddFilers > 0 {
+		inv.add(e.AddFilers, e.Zone, zones, e.Tags)
+	}
+	if e.RemoveFilers > 0 {
+		inv.remove(e.RemoveFilers)
+	}
+	if e.DeactivateFilers > 0 {
+		inv.deactivate(e.DeactivateFilers)
+	}
+	if e.ProbeFailureRate != nil {
+		o.setFailureRate(*e.ProbeFailureRate)
+	}
+	if e.NetboxDown != nil {
+		inv.setDown(*e.NetboxDown)
+	}
+	if e.WipeLabels {
+		if err := c.wipeLabels(ctx); err != nil {
+			return err
+		}
+	}
+	if e.KillPods > 0 {
+		if err := c.killPods(ctx, e.KillPods); err != nil {
+			return err
+		}
+	}
+	if e.ZoneDown != "" {
+		if err := c.setZoneDown(ctx, e.ZoneDown, true); err != nil {
+			return err
+		}
+	}
+	if e.ZoneUp != "" {
+		if err := c.setZoneDown(ctx, e.ZoneUp, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe returns a short description of the events of a step.
+func describe(events []Event) []string {
+	descriptions := make([]string, 0)
+	for _, e := range events {
+		if e.AddFilers > 0 {
+			d := fmt.Sprintf("add %d filers", e.AddFilers)
+			if e.Zone != "" {
+				d += " in zone " + e.Zone
+			}
+			if len(e.Tags) > 0 {
+				d += " tagged " + strings.Join(e.Tags, ",")
+			}
+			descriptions = append(descriptions, d)
+		}
+		if e.RemoveFilers > 0 {
+			descriptions = append(descriptions, fmt.Sprintf("remove %d filers", e.RemoveFilers))
+		}
+		if e.DeactivateFilers > 0 {
+			descriptions = append(descriptions, fmt.Sprintf("deactivate %d filers", e.DeactivateFilers))
+		}
+		if e.ProbeFailureRate != nil {
+			descriptions = append(descriptions, fmt.Sprintf("probe failure rate %g", *e.ProbeFailureRate))
+		}
+		if e.NetboxDown != nil {
+			if *e.NetboxDown {
+				descriptions = append(descriptions, "netbox down")
+			} else {
+				descriptions = append(descriptions, "netbox up")
+			}
+		}
+		if e.WipeLabels {
+			descriptions = append(descriptions, "wipe filer labels")
+		}
+		if e.KillPods > 0 {
+			descriptions = append(descriptions, fmt.Sprintf("kill %d pods", e.KillPods))
+		}
+		if e.ZoneDown != "" {
+			descriptions = append(descriptions, "zone "+e.ZoneDown+" down")
+		}
+		if e.ZoneUp != "" {
+			descriptions = append(descriptions, "zone "+e.ZoneUp+" up")
+		}
+	}
+	return descriptions
+}
+
+// runWorkers lets every started worker pod without a filer request one from
+// the master, and returns the number of filers assigned.
+func runWorkers(ctx context.Context, c *cluster, n *netappsd.NetAppSD, step int) (int, error) {
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return 0, err
+	}
+	assignments := 0
+	for _, pod := range pods {
+		if _, found := pod.Labels["filer"]; found {
+			continue
+		}
+		c.mu.Lock()
+		started := c.started(pod.Name, step)
+		c.mu.Unlock()
+		if !started {
+			continue
+		}
+		if _, err := n.NextFiler(ctx, pod.Name); err == nil {
+			assignments++
+		}
+	}
+	return assignments, nil
+}
+
+func observe(ctx context.Context, c *cluster, n *netappsd.NetAppSD, inv *inventory, o *ontap) (StepStats, error) {
+	var stats StepStats
+	replicas, err := c.replicas(ctx)
+	if err != nil {
+		return stats, err
+	}
+	pods, err := c.listPods(ctx)
+	if err != nil {
+		return stats, err
+	}
+	expected := inv.expected(o)
+	active := inv.active()
+	assigned := make(map[string]struct{})
+	for _, pod := range pods {
+		if filer, found := pod.Labels["filer"]; found {
+			assigned[filer] = struct{}{}
+		}
+	}
+	for filer := range assigned {
+		if _, found := active[filer]; !found {
+			stats.Stale++
+		}
+	}
+	for filer := range expected {
+		if _, found := assigned[filer]; !found {
+			stats.Unassigned++
+		}
+	}
+	scaling := n.Scaling()
+	stats.Replicas = replicas
+	stats.Pods = len(pods)
+	stats.Assigned = len(assigned)
+	stats.Desired = scaling.Desired
+	stats.Queued = scaling.Queued
+	stats.Expected = len(expected)
+	stats.Converged = stats.Unassigned == 0 && stats.Stale == 0 &&
+		stats.Pods <= max(stats.Assigned, int(n.MinReplicas))
+	return stats, nil
+}
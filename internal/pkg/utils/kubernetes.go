@@ -1,14 +1,68 @@
 package utils
 
 import (
+	"errors"
+	"log/slog"
+
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	kubeConfigPath string
+	kubeContext    string
 )
 
+// SetKubeConfig sets the kubeconfig file and context of the clients. If
+// either is set, the clients use the kubeconfig even inside a cluster.
+func SetKubeConfig(path, context string) {
+	kubeConfigPath = path
+	kubeContext = context
+}
+
+// KubeConfig returns the in-cluster config, or outside of a cluster the
+// config of the kubeconfig file, which defaults to $KUBECONFIG or
+// ~/.kube/config, and its current context.
+func KubeConfig() (*rest.Config, error) {
+	if kubeConfigPath == "" && kubeContext == "" {
+		config, err := rest.InClusterConfig()
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return config, err
+		}
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeConfigPath
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if rawConfig, err := clientConfig.RawConfig(); err == nil {
+		context := kubeContext
+		if context == "" {
+			context = rawConfig.CurrentContext
+		}
+		slog.Info("using kubeconfig", "context", context, "host", config.Host)
+	}
+	return config, nil
+}
+
 func NewKubeClient() (*kubernetes.Clientset, error) {
-	config, err := rest.InClusterConfig()
+	config, err := KubeConfig()
 	if err != nil {
 		return nil, err
 	}
 	return kubernetes.NewForConfig(config)
 }
+
+// NewDynamicClient returns a client for custom resources.
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := KubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}